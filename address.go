@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+)
+
+// splits an address list on the commas between addresses, leaving the ones
+// inside quoted names, comments and angle brackets alone. Groups, e.g.
+// "Team: a@example.com, b@example.com;", are split into their members and
+// the group name is dropped
+func splitAddressList(field string) []string {
+	var entries []string
+	inQuotes, escaped, inGroup := false, false, false
+	depthAngle, depthComment := 0, 0
+	start := 0
+	for i, r := range field {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' && depthComment == 0:
+			inQuotes = !inQuotes
+		case inQuotes:
+		case r == '(':
+			depthComment++
+		case r == ')' && depthComment > 0:
+			depthComment--
+		case r == '<' && depthComment == 0:
+			depthAngle++
+		case r == '>' && depthAngle > 0 && depthComment == 0:
+			depthAngle--
+		case depthAngle > 0 || depthComment > 0:
+		case r == ':' && !inGroup:
+			inGroup = true
+			start = i + 1
+		case r == ';' && inGroup:
+			inGroup = false
+			entries = append(entries, field[start:i])
+			start = i + 1
+		case r == ',':
+			entries = append(entries, field[start:i])
+			start = i + 1
+		}
+	}
+	entries = append(entries, field[start:])
+
+	nonEmpty := entries[:0]
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			nonEmpty = append(nonEmpty, entry)
+		}
+	}
+	return nonEmpty
+}
+
+// parses a to/cc field as an rfc 5322 address list, errors name the entry
+// that is malformed. Empty entries, e.g. from a trailing comma, are skipped
+func parseAddressList(field string) ([]*netmail.Address, error) {
+	var addresses []*netmail.Address
+	var errs []string
+	parser := netmail.AddressParser{WordDecoder: headerWordDecoder}
+	for _, entry := range splitAddressList(field) {
+		address, err := parser.Parse(entry)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("\"%s\": %s", entry,
+				strings.TrimPrefix(err.Error(), "mail: ")))
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+
+	if len(errs) > 0 {
+		return addresses, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return addresses, nil
+}
+
+// formats addresses for display and editing, names are left unencoded
+func formatAddressList(addresses []*netmail.Address) string {
+	var entries []string
+	for _, address := range addresses {
+		entries = append(entries, Contact{
+			Address: address.Address,
+			Name:    address.Name,
+		}.String())
+	}
+	return strings.Join(entries, ", ")
+}
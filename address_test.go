@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitAddressList(t *testing.T) {
+	tests := []struct {
+		field string
+		want  []string
+	}{
+		{"a@example.com, b@example.com",
+			[]string{"a@example.com", "b@example.com"}},
+		{`"Doe, Jane" <jane@example.com>, bob@example.com`,
+			[]string{`"Doe, Jane" <jane@example.com>`, "bob@example.com"}},
+		{`"say \"hi, there\"" <a@example.com>`,
+			[]string{`"say \"hi, there\"" <a@example.com>`}},
+		{"jane@example.com (Doe, Jane), bob@example.com",
+			[]string{"jane@example.com (Doe, Jane)", "bob@example.com"}},
+		{"a@example.com,, b@example.com,  ,",
+			[]string{"a@example.com", "b@example.com"}},
+		{"Team: a@example.com, \"B, Bee\" <b@example.com>;, c@example.com",
+			[]string{"a@example.com", `"B, Bee" <b@example.com>`,
+				"c@example.com"}},
+		{"undisclosed-recipients:;", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got := splitAddressList(test.field)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitAddressList(%q) = %q, want %q", test.field, got,
+				test.want)
+		}
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{`"Doe, Jane" <jane@example.com>`, `"Doe, Jane" <jane@example.com>`},
+		{"a@example.com, Bob <bob@example.com>,",
+			"a@example.com, Bob <bob@example.com>"},
+		{"=?utf-8?q?Jos=C3=A9?= <jose@example.com>",
+			"José <jose@example.com>"},
+		{"=?iso-8859-1?q?Ren=E9?= <rene@example.com>",
+			"René <rene@example.com>"},
+		{"Team: a@example.com, b@example.com;",
+			"a@example.com, b@example.com"},
+	}
+	for _, test := range tests {
+		addresses, err := parseAddressList(test.field)
+		if err != nil {
+			t.Errorf("parseAddressList(%q): %v", test.field, err)
+			continue
+		}
+		if got := formatAddressList(addresses); got != test.want {
+			t.Errorf("parseAddressList(%q) = %q, want %q", test.field, got,
+				test.want)
+		}
+	}
+}
+
+func TestParseAddressListInvalid(t *testing.T) {
+	addresses, err := parseAddressList(
+		"a@example.com, not an address, <b@example.com")
+	if err == nil {
+		t.Fatalf("parseAddressList didn't fail")
+	}
+	for _, entry := range []string{`"not an address"`, `"<b@example.com"`} {
+		if !strings.Contains(err.Error(), entry) {
+			t.Errorf("error %q doesn't name %s", err, entry)
+		}
+	}
+	if len(addresses) != 1 || addresses[0].Address != "a@example.com" {
+		t.Errorf("valid addresses %v, want a@example.com", addresses)
+	}
+}
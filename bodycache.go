@@ -0,0 +1,276 @@
+package main
+
+import (
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+)
+
+const bodyCacheMBDefault = 64
+
+// downloaded bodies are kept in memory up to body_cache_mb, the least
+// recently viewed are written out to disk past that and read back when
+// they're viewed again. Uids can change between sessions, so the files are
+// only for this session and cleared on exit, or on startup after a crash.
+// Decrypted emails never go to disk, they're downloaded again instead
+type BodyCacheKey struct {
+	folder string
+	uid    uint32
+}
+
+type bodyCacheItem struct {
+	key   BodyCacheKey
+	bytes int64
+}
+
+// a body written out to disk, attachments that were only listed keep the
+// part to download them from
+type BodyCacheEntry struct {
+	Body           string
+	BodyHTML       string `json:",omitempty"`
+	Security       string `json:",omitempty"`
+	SizeDownloaded uint64
+	Attachments    []BodyCacheAttachment `json:",omitempty"`
+}
+
+type BodyCacheAttachment struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Data        []byte              `json:",omitempty"`
+	PartPath    []int               `json:",omitempty"`
+	Part        *imap.BodyStructure `json:",omitempty"`
+}
+
+var (
+	// guarded by g_emailsMu, most recently used at the front
+	g_bodyCacheLru      *list.List
+	g_bodyCacheElements map[BodyCacheKey]*list.Element
+	g_bodyCacheBytes    int64
+
+	g_bodyCacheHits     atomic.Int64
+	g_bodyCacheDiskHits atomic.Int64
+	g_bodyCacheMisses   atomic.Int64
+)
+
+func bodyCacheInit() {
+	g_bodyCacheLru = list.New()
+	g_bodyCacheElements = make(map[BodyCacheKey]*list.Element)
+	bodyCacheClear()
+}
+
+func bodyCacheClear() {
+	err := os.RemoveAll(bodyCacheDir())
+	if err != nil {
+		log.Printf("unable to clear body cache: %v", err)
+	}
+}
+
+func bodyCacheDir() string {
+	return dataFilePath("bodies")
+}
+
+func bodyCachePath(key BodyCacheKey) string {
+	return filepath.Join(bodyCacheDir(),
+		fmt.Sprintf("%s-%d.json", hex.EncodeToString([]byte(key.folder)),
+			key.uid))
+}
+
+func emailSecurityIsDecrypted(security string) bool {
+	return strings.HasPrefix(security, pgpStatusDecrypted) ||
+		strings.HasPrefix(security, smimeStatusDecrypted)
+}
+
+func bodyCacheBudget() int64 {
+	mb := g_config.BodyCacheMB
+	if mb <= 0 {
+		mb = bodyCacheMBDefault
+	}
+	return int64(mb) << 20
+}
+
+func emailBodyBytes(email *Email) int64 {
+	n := int64(len(email.body) + len(email.bodyHTML))
+	for _, attachment := range email.attachments {
+		n += int64(len(attachment.data))
+	}
+	return n
+}
+
+// counts a body that was just set, and returns the bodies evicted to make
+// room for it, to be written out once the lock is released
+func bodyCacheAddLocked(email *Email) []Email {
+	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
+	key := BodyCacheKey{email.folder, email.uid}
+	if element, ok := g_bodyCacheElements[key]; ok {
+		g_bodyCacheBytes -= element.Value.(*bodyCacheItem).bytes
+		g_bodyCacheLru.Remove(element)
+	}
+	bytes := emailBodyBytes(email)
+	g_bodyCacheElements[key] = g_bodyCacheLru.PushFront(
+		&bodyCacheItem{key, bytes})
+	g_bodyCacheBytes += bytes
+
+	var evicted []Email
+	for g_bodyCacheBytes > bodyCacheBudget() && g_bodyCacheLru.Len() > 1 {
+		item := g_bodyCacheLru.Back().Value.(*bodyCacheItem)
+		bodyCacheForgetLocked(item.key)
+		emailEvicted, ok := g_emailFromUid[item.key.folder][item.key.uid]
+		if !ok || emailEvicted.body == "" {
+			continue
+		}
+		evicted = append(evicted, *emailEvicted)
+		emailEvicted.body = ""
+		emailEvicted.bodyHTML = ""
+		emailEvicted.attachments = nil
+		emailEvicted.security = ""
+	}
+	return evicted
+}
+
+func bodyCacheTouchLocked(key BodyCacheKey) {
+	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
+	if element, ok := g_bodyCacheElements[key]; ok {
+		g_bodyCacheLru.MoveToFront(element)
+	}
+}
+
+func bodyCacheForgetLocked(key BodyCacheKey) {
+	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
+	element, ok := g_bodyCacheElements[key]
+	if !ok {
+		return
+	}
+	g_bodyCacheBytes -= element.Value.(*bodyCacheItem).bytes
+	g_bodyCacheLru.Remove(element)
+	delete(g_bodyCacheElements, key)
+}
+
+// for emails that are gone, a body on disk would otherwise be read back for
+// a later email given the same uid, e.g. in a folder created with the name
+// of one that was deleted
+func bodyCacheRemoveLocked(key BodyCacheKey) {
+	bodyCacheForgetLocked(key)
+	err := os.Remove(bodyCachePath(key))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove cached body of email %d: %v", key.uid,
+			err)
+	}
+}
+
+func bodyCacheRemoveFolderLocked(folder string) {
+	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
+	for key := range g_bodyCacheElements {
+		if key.folder == folder {
+			bodyCacheForgetLocked(key)
+		}
+	}
+	paths, _ := filepath.Glob(filepath.Join(bodyCacheDir(),
+		hex.EncodeToString([]byte(folder))+"-*.json"))
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("unable to remove cached body \"%s\": %v", path, err)
+		}
+	}
+}
+
+func bodyCacheSpill(emails []Email) {
+	for _, email := range emails {
+		if emailSecurityIsDecrypted(email.security) {
+			continue
+		}
+		entry := BodyCacheEntry{
+			Body:           email.body,
+			BodyHTML:       email.bodyHTML,
+			Security:       email.security,
+			SizeDownloaded: email.sizeDownloaded,
+		}
+		for _, attachment := range email.attachments {
+			spilled := BodyCacheAttachment{
+				Filename:    attachment.filename,
+				ContentType: attachment.contentType,
+				Size:        attachment.size,
+				Data:        attachment.data,
+			}
+			if attachment.part != nil {
+				spilled.PartPath = attachment.part.path
+				spilled.Part = attachment.part.structure
+			}
+			entry.Attachments = append(entry.Attachments, spilled)
+		}
+
+		data, err := json.Marshal(entry)
+		if err == nil {
+			err = os.MkdirAll(bodyCacheDir(), 0o700)
+		}
+		if err == nil {
+			err = writeFileAtomic(
+				bodyCachePath(BodyCacheKey{email.folder, email.uid}), data)
+		}
+		if err != nil {
+			log.Printf("unable to write body of email %d to disk: %v",
+				email.uid, err)
+			continue
+		}
+
+		// the email may have gone while it was being written
+		g_emailsMu.Lock()
+		if _, ok := g_emailFromUid[email.folder][email.uid]; !ok {
+			bodyCacheRemoveLocked(BodyCacheKey{email.folder, email.uid})
+		}
+		g_emailsMu.Unlock()
+	}
+}
+
+// reads a body evicted earlier back into memory, false when there's none and
+// it needs to be downloaded again
+func bodyCacheRestore(folder string, uid uint32) bool {
+	path := bodyCachePath(BodyCacheKey{folder, uid})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var entry BodyCacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || entry.Body == "" {
+		log.Printf("unable to parse cached body \"%s\": %v", path, err)
+		return false
+	}
+
+	var attachments []Attachment
+	for _, spilled := range entry.Attachments {
+		attachment := Attachment{
+			filename:    spilled.Filename,
+			contentType: spilled.ContentType,
+			size:        spilled.Size,
+			data:        spilled.Data,
+		}
+		if spilled.Part != nil {
+			attachment.part = &MimePart{
+				path: spilled.PartPath, structure: spilled.Part,
+			}
+		}
+		attachments = append(attachments, attachment)
+	}
+	return cachedEmailBodyRestore(folder, uid, entry, attachments)
+}
+
+func bodyCacheStats() string {
+	g_emailsMu.Lock()
+	bytes := g_bodyCacheBytes
+	g_emailsMu.Unlock()
+	return fmt.Sprintf("body cache %s of %s, %d hits, %d from disk, %d misses",
+		FormatHumanReadableSize(bytes),
+		FormatHumanReadableSize(bodyCacheBudget()),
+		g_bodyCacheHits.Load(), g_bodyCacheDiskHits.Load(),
+		g_bodyCacheMisses.Load())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// sets a body of 600kB, so with a 1MB cache the one set before is evicted
+func testSetLargeBody(uid uint32, security string) {
+	cachedEmailEnvelopeSet(&Email{uid: uid, seqNum: uid, folder: "Inbox"})
+	body := strings.Repeat("x", 600<<10)
+	cachedEmailBodyUpdate("Inbox", uid, body, nil, 0, 0, true, security)
+}
+
+func testBodyCacheFileExists(uid uint32) bool {
+	_, err := os.Stat(bodyCachePath(BodyCacheKey{"Inbox", uid}))
+	return err == nil
+}
+
+func TestBodyCacheSpill(t *testing.T) {
+	testModelInit(t)
+	g_config.BodyCacheMB = 1
+
+	testSetLargeBody(1, "")
+	testSetLargeBody(2, pgpStatusDecrypted+", verified signature from a")
+	testSetLargeBody(3, smimeStatusDecrypted)
+	testSetLargeBody(4, "")
+
+	if !testBodyCacheFileExists(1) {
+		t.Errorf("evicted body wasn't written to disk")
+	}
+	if testBodyCacheFileExists(2) || testBodyCacheFileExists(3) {
+		t.Errorf("decrypted body was written to disk")
+	}
+	if bodyCacheRestore("Inbox", 2) {
+		t.Errorf("decrypted body was restored rather than downloaded again")
+	}
+
+	if !bodyCacheRestore("Inbox", 1) {
+		t.Fatalf("evicted body wasn't restored")
+	}
+	if email := cachedEmailFromUid("Inbox", 1); len(email.body) != 600<<10 {
+		t.Errorf("restored body is %d bytes, want %d", len(email.body),
+			600<<10)
+	}
+}
+
+func TestBodyCacheRemove(t *testing.T) {
+	testModelInit(t)
+	g_config.BodyCacheMB = 1
+
+	testSetLargeBody(1, "")
+	testSetLargeBody(2, "")
+	testSetLargeBody(3, "")
+	if !testBodyCacheFileExists(1) || !testBodyCacheFileExists(2) {
+		t.Fatalf("evicted bodies weren't written to disk")
+	}
+
+	if !cachedEmailRemoveViaUid("Inbox", 1) {
+		t.Fatalf("email wasn't removed")
+	}
+	if testBodyCacheFileExists(1) {
+		t.Errorf("body of a removed email is still on disk")
+	}
+
+	// a folder of the same name starts its uids over
+	cachedEmailFolderClear("Inbox")
+	if testBodyCacheFileExists(2) {
+		t.Errorf("body of a cleared folder is still on disk")
+	}
+	cachedEmailEnvelopeSet(&Email{uid: 2, folder: "Inbox"})
+	if bodyCacheRestore("Inbox", 2) {
+		t.Errorf("body of a cleared folder was restored for a new email")
+	}
+}
+
+func TestForwardEvictedEmail(t *testing.T) {
+	testModelInit(t)
+	g_config.BodyCacheMB = 1
+
+	cachedEmailEnvelopeSet(&Email{uid: 1, seqNum: 1, folder: "Inbox"})
+	attachments := []Attachment{{filename: "report.pdf",
+		contentType: "application/pdf", data: []byte("%PDF-1.4"), size: 8}}
+	cachedEmailBodyUpdate("Inbox", 1, "see attached", attachments, 0, 0, true,
+		"")
+	testSetLargeBody(2, "")
+	testSetLargeBody(3, "")
+	if email := cachedEmailFromUid("Inbox", 1); email.body != "" ||
+		email.attachments != nil {
+		t.Fatalf("email to forward wasn't evicted")
+	}
+
+	forwarded, err := fetchEmailForwardAttachments("Inbox", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 1 || forwarded[0].filename != "report.pdf" ||
+		string(forwarded[0].data) != "%PDF-1.4" {
+		t.Errorf("forwarded attachments %+v, want report.pdf", forwarded)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	archiveFolderDefault = "Archive"
+	trashFolderDefault   = "Trash"
+	junkFolderDefault    = "Junk"
+	// uids per command, so a whole folder doesn't go out as one line
+	bulkBatchSize = 200
+)
+
+// the last bulk action, undone as a whole with u. Moved emails get new uids
+// in the folder they were moved to, from its uidnext on, and are found there
+// again by message-id
+type BulkUndo struct {
+	folder      string
+	description string
+
+	movedTo     string
+	movedUidMin uint32
+	messageIds  map[string]bool
+
+	flag        string
+	flagSet     []uint32
+	flagCleared []uint32
+}
+
+func archiveFolder() string {
+	if g_config.ArchiveFolder != "" {
+		return g_config.ArchiveFolder
+	}
+	return archiveFolderDefault
+}
+
+func trashFolder() string {
+	if g_config.TrashFolder != "" {
+		return g_config.TrashFolder
+	}
+	return trashFolderDefault
+}
+
+func junkFolder() string {
+	if g_config.JunkFolder != "" {
+		return g_config.JunkFolder
+	}
+	return junkFolderDefault
+}
+
+func bulkBatches(uids []uint32) []*imap.SeqSet {
+	var batches []*imap.SeqSet
+	for len(uids) > 0 {
+		n := min(len(uids), bulkBatchSize)
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids[:n]...)
+		batches = append(batches, seqSet)
+		uids = uids[n:]
+	}
+	return batches
+}
+
+func emailsUids(emails []Email) []uint32 {
+	uids := make([]uint32, 0, len(emails))
+	for _, email := range emails {
+		uids = append(uids, email.uid)
+	}
+	return uids
+}
+
+// marks
+//
+
+func emailIsMarked(uid uint32) bool {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	return g_ui.markedUids[uid]
+}
+
+func markSet(uid uint32, marked bool) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if marked {
+		g_ui.markedUids[uid] = true
+	} else {
+		delete(g_ui.markedUids, uid)
+	}
+	if row := slices.Index(g_ui.emailsUidList, uid); row != -1 {
+		updateImapEmailInTable(row,
+			cachedEmailFromUid(g_ui.folderSelected, uid))
+	}
+}
+
+func marksClear() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	marked := g_ui.markedUids
+	g_ui.markedUids = make(map[uint32]bool)
+	g_ui.markAnchorUid = 0
+	for uid := range marked {
+		if row := slices.Index(g_ui.emailsUidList, uid); row != -1 {
+			updateImapEmailInTable(row,
+				cachedEmailFromUid(g_ui.folderSelected, uid))
+		}
+	}
+}
+
+func markCanUse() bool {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderSelected == outboxFolder || len(g_ui.emailsUidList) == 0 {
+		updateStatusBar("No emails to mark")
+		return false
+	}
+	return true
+}
+
+// toggles the selected email and moves down, so x can be held
+func markToggleSelected() {
+	if !markCanUse() {
+		return
+	}
+	row, _ := g_ui.emailsTable.GetSelection()
+	uid := g_ui.emailsUidList[row]
+	markSet(uid, !emailIsMarked(uid))
+	g_ui.markAnchorUid = uid
+	g_ui.emailsPegSelectionToTop = false
+	if row+1 < len(g_ui.emailsUidList) {
+		g_ui.emailsTable.Select(row+1, 0)
+	}
+	updateEmailStatusBarWithSelection()
+}
+
+// marks every row from the last one toggled with x to the selected one
+func markRange() {
+	if !markCanUse() {
+		return
+	}
+	row, _ := g_ui.emailsTable.GetSelection()
+	anchor := slices.Index(g_ui.emailsUidList, g_ui.markAnchorUid)
+	if anchor == -1 {
+		anchor = row
+	}
+	for i := min(anchor, row); i <= max(anchor, row); i++ {
+		markSet(g_ui.emailsUidList[i], true)
+	}
+	g_ui.markAnchorUid = g_ui.emailsUidList[row]
+	updateEmailStatusBarWithSelection()
+}
+
+// marks every row matching the filter, or unmarks everything when they
+// already are
+func markAllShown() {
+	if !markCanUse() {
+		return
+	}
+	allMarked := true
+	for _, uid := range g_ui.emailsUidList {
+		allMarked = allMarked && emailIsMarked(uid)
+	}
+	if allMarked {
+		marksClear()
+	} else {
+		for _, uid := range g_ui.emailsUidList {
+			markSet(uid, true)
+		}
+	}
+	updateEmailStatusBarWithSelection()
+}
+
+// marks the rows with the same subject once re: and fwd: are left out, the
+// way ORDEREDSUBJECT threads them
+func markThread() {
+	if !markCanUse() {
+		return
+	}
+	folder := g_ui.folderSelected
+	row, _ := g_ui.emailsTable.GetSelection()
+	subject := emailBaseSubject(
+		cachedEmailFromUid(folder, g_ui.emailsUidList[row]).subject)
+	n := 0
+	for _, uid := range g_ui.emailsUidList {
+		if emailBaseSubject(cachedEmailFromUid(folder, uid).subject) == subject {
+			markSet(uid, true)
+			n++
+		}
+	}
+	updateEmailStatusBarWithSelection()
+	updateStatusBar(fmt.Sprintf("Marked %d emails in the thread", n))
+}
+
+// the marked emails, or the selected one when none are marked
+func bulkTargets() []Email {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := g_ui.folderSelected
+	if folder == outboxFolder || len(g_ui.emailsUidList) == 0 {
+		return nil
+	}
+	var emails []Email
+	for _, uid := range g_ui.emailsUidListAll {
+		if emailIsMarked(uid) {
+			emails = append(emails, cachedEmailFromUid(folder, uid))
+		}
+	}
+	if len(emails) == 0 {
+		row, _ := g_ui.emailsTable.GetSelection()
+		emails = append(emails,
+			cachedEmailFromUid(folder, g_ui.emailsUidList[row]))
+	}
+	return emails
+}
+
+func emailsCountText(n int) string {
+	if n == 1 {
+		return "1 email"
+	}
+	return fmt.Sprintf("%d emails", n)
+}
+
+// actions
+//
+
+func bulkMoveSelected(to string, verb string) {
+	emails := bulkTargets()
+	if len(emails) == 0 {
+		updateStatusBar("No message selected to " + verb)
+		return
+	}
+	folder := g_ui.folderSelected
+	if getNormalizedImapFolderName(to) == folder {
+		updateStatusBar(fmt.Sprintf("Already in %s", folder))
+		return
+	}
+	marksClear()
+	go bulkMove(folder, emails, to, verb)
+}
+
+func bulkMovePrompt() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if len(bulkTargets()) == 0 {
+		updateStatusBar("No message selected to move")
+		return
+	}
+	showPrompt("Move to folder:", "e.g. Archive/2025", func(text string) {
+		if text != "" {
+			bulkMoveSelected(text, "move")
+		}
+	})
+}
+
+func bulkMove(folder string, emails []Email, to string, verb string) {
+	undo := &BulkUndo{
+		folder: folder,
+		description: fmt.Sprintf("%s of %s", verb,
+			emailsCountText(len(emails))),
+		movedTo:    to,
+		messageIds: make(map[string]bool),
+	}
+	var moved []uint32
+	isMoved := make(map[uint32]bool)
+	err := imapCommand(folder, func(clt *client.Client) error {
+		// fails when the folder is already there, which is fine, folders
+		// typed in have to be there already
+		if to == archiveFolder() || to == trashFolder() || to == junkFolder() {
+			_ = clt.Create(to)
+		}
+		status, err := clt.Status(to, []imap.StatusItem{imap.StatusUidNext})
+		if err != nil {
+			return err
+		}
+		undo.movedUidMin = status.UidNext
+
+		for _, batch := range bulkBatches(emailsUids(emails)) {
+			updateStatusBar(fmt.Sprintf("Moving %d of %d emails to %s",
+				len(moved), len(emails), to))
+			err := clt.UidMove(batch, to)
+			if err != nil {
+				return err
+			}
+			for _, uid := range uidsFromSeqSet(batch) {
+				moved = append(moved, uid)
+				isMoved[uid] = true
+			}
+		}
+		return nil
+	})
+
+	for _, email := range emails {
+		if !isMoved[email.uid] {
+			continue
+		}
+		if email.messageId != "" {
+			undo.messageIds[email.messageId] = true
+		}
+		// expunges from the idle folder reach us on their own
+		if folder != imapIdleFolder {
+			notifyEmailMoved(folder, email.uid)
+		}
+	}
+	if len(moved) > 0 {
+		notifyBulkUndoSet(undo)
+	}
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Unable to %s %s, moved %d to %s: %v",
+			verb, emailsCountText(len(emails)), len(moved), to, err))
+		return
+	}
+	updateStatusBar(fmt.Sprintf("Moved %s to %s, [%s]u[%s]:Undo",
+		emailsCountText(len(moved)), to, coShortcutText, coMainStatusBarText))
+}
+
+func uidsFromSeqSet(seqSet *imap.SeqSet) []uint32 {
+	var uids []uint32
+	for _, seq := range seqSet.Set {
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// sets the flag on all of them, unless they all have it already, then it's
+// cleared from all of them
+func bulkToggleFlagSelected(flag string) {
+	emails := bulkTargets()
+	if len(emails) == 0 {
+		updateStatusBar("No message selected")
+		return
+	}
+	on := false
+	for _, email := range emails {
+		on = on || !emailHasFlag(email, flag)
+	}
+	marksClear()
+	go bulkSetFlag(g_ui.folderSelected, emails, flag, on)
+}
+
+func bulkSetFlagSelected(flag string, on bool) {
+	emails := bulkTargets()
+	if len(emails) == 0 {
+		updateStatusBar("No message selected")
+		return
+	}
+	marksClear()
+	go bulkSetFlag(g_ui.folderSelected, emails, flag, on)
+}
+
+func emailHasFlag(email Email, flag string) bool {
+	if flag == imap.SeenFlag {
+		return email.isRead
+	}
+	return email.isFlagged
+}
+
+func flagDescription(flag string, on bool) string {
+	switch {
+	case flag == imap.SeenFlag && on:
+		return "read"
+	case flag == imap.SeenFlag:
+		return "unread"
+	case on:
+		return "flagged"
+	}
+	return "unflagged"
+}
+
+// only the emails that didn't have it yet are changed, so undo knows what
+// they were before
+func bulkSetFlag(folder string, emails []Email, flag string, on bool) {
+	var uids []uint32
+	for _, email := range emails {
+		if emailHasFlag(email, flag) != on {
+			uids = append(uids, email.uid)
+		}
+	}
+	description := flagDescription(flag, on)
+	undo := &BulkUndo{
+		folder: folder,
+		description: fmt.Sprintf("marking %s %s",
+			emailsCountText(len(emails)), description),
+		flag: flag,
+	}
+
+	var done []uint32
+	err := bulkStoreFlag(folder, uids, flag, on, func(batch []uint32) {
+		done = append(done, batch...)
+		updateStatusBar(fmt.Sprintf("Marking %d of %d emails %s",
+			len(done), len(uids), description))
+	})
+	if on {
+		undo.flagSet = done
+	} else {
+		undo.flagCleared = done
+	}
+	if len(done) > 0 {
+		notifyBulkUndoSet(undo)
+	}
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Unable to mark %s %s, did %d: %v",
+			emailsCountText(len(emails)), description, len(done), err))
+		return
+	}
+	updateStatusBar(fmt.Sprintf("Marked %s %s, [%s]u[%s]:Undo",
+		emailsCountText(len(emails)), description, coShortcutText,
+		coMainStatusBarText))
+}
+
+// stores the flag batch by batch, updating the cache and table after each
+func bulkStoreFlag(folder string, uids []uint32, flag string, on bool,
+	progress func(batch []uint32)) error {
+	var op imap.FlagsOp = imap.AddFlags
+	if !on {
+		op = imap.RemoveFlags
+	}
+	return imapCommand(folder, func(clt *client.Client) error {
+		for _, batch := range bulkBatches(uids) {
+			err := clt.UidStore(batch, imap.FormatFlagsOp(op, true),
+				[]interface{}{flag}, nil)
+			if err != nil {
+				return err
+			}
+			batchUids := uidsFromSeqSet(batch)
+			for _, uid := range batchUids {
+				cachedEmailSetFlag(folder, uid, flag, on)
+			}
+			notifyEmailsChanged(folder, batchUids)
+			progress(batchUids)
+		}
+		return nil
+	})
+}
+
+func notifyBulkUndoSet(undo *BulkUndo) {
+	g_ui.app.QueueUpdate(func() { g_ui.bulkUndo = undo })
+}
+
+func notifyEmailsChanged(folder string, uids []uint32) {
+	g_ui.app.QueueUpdateDraw(func() {
+		if g_ui.folderSelected != folder {
+			return
+		}
+		for _, uid := range uids {
+			if row := slices.Index(g_ui.emailsUidList, uid); row != -1 {
+				updateImapEmailInTable(row, cachedEmailFromUid(folder, uid))
+			}
+		}
+	})
+}
+
+// undoes the last bulk action in one go
+func bulkUndoLast() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	undo := g_ui.bulkUndo
+	g_ui.bulkUndo = nil
+	if undo == nil {
+		updateStatusBar("Nothing to undo")
+		return
+	}
+	go func() {
+		var err error
+		if undo.movedTo != "" {
+			err = bulkUndoMove(undo)
+		} else {
+			err = bulkStoreFlag(undo.folder, undo.flagSet, undo.flag, false,
+				func([]uint32) {})
+			if err == nil {
+				err = bulkStoreFlag(undo.folder, undo.flagCleared, undo.flag,
+					true, func([]uint32) {})
+			}
+		}
+		if err != nil {
+			updateStatusBar(fmt.Sprintf("Unable to undo %s: %v",
+				undo.description, err))
+			return
+		}
+		updateStatusBar("Undid " + undo.description)
+	}()
+}
+
+func bulkUndoMove(undo *BulkUndo) error {
+	if len(undo.messageIds) == 0 {
+		return fmt.Errorf("emails without a Message-Id can't be found in %s",
+			undo.movedTo)
+	}
+	err := imapCommand(undo.movedTo, func(clt *client.Client) error {
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(undo.movedUidMin, 0)
+		candidates, err := clt.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+
+		var uids []uint32
+		for _, batch := range bulkBatches(candidates) {
+			chEmails := make(chan *imap.Message, 10)
+			done := make(chan error, 1)
+			go func() {
+				done <- clt.UidFetch(batch,
+					[]imap.FetchItem{imap.FetchUid, imap.FetchEnvelope},
+					chEmails)
+			}()
+			for imapEmail := range chEmails {
+				if undo.messageIds[imapEmail.Envelope.MessageId] {
+					uids = append(uids, imapEmail.Uid)
+				}
+			}
+			err = <-done
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, batch := range bulkBatches(uids) {
+			updateStatusBar(fmt.Sprintf("Moving %d of %d emails back to %s",
+				i*bulkBatchSize, len(uids), undo.folder))
+			err = clt.UidMove(batch, undo.folder)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && undo.folder != imapIdleFolder {
+		notifyFolderChanged(undo.folder)
+	}
+	return err
+}
+
+// u undoes a send that's still held first, then the last bulk action
+func undoLast() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.undoSendId != 0 || g_ui.bulkUndo == nil {
+		undoSend()
+		return
+	}
+	bulkUndoLast()
+}
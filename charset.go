@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var headerWordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+func charsetInit() {
+	// go-imap decodes RFC 2047 words in envelopes with this, importing
+	// go-message/charset has already registered the same for bodies
+	imap.CharsetReader = charset.Reader
+}
+
+// decodes RFC 2047 encoded words that made it through undecoded (e.g. words
+// in an unknown charset, or servers that don't decode envelopes), and falls
+// back on windows-1252 for raw 8-bit headers that aren't valid utf-8
+func decodeHeaderText(s string) string {
+	if strings.Contains(s, "=?") {
+		decoded, err := headerWordDecoder.DecodeHeader(s)
+		if err == nil {
+			s = decoded
+		}
+	}
+	return decodeAsUTF8(s)
+}
+
+// go-message has already converted text parts with a known charset to utf-8,
+// this catches parts that had no charset, or one we couldn't decode
+func decodeBodyText(body io.Reader) string {
+	data, _ := io.ReadAll(body)
+	return decodeAsUTF8(string(data))
+}
+
+func decodeAsUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	decoded, err := charmap.Windows1252.NewDecoder().String(s)
+	if err != nil {
+		return strings.ToValidUTF8(s, string(utf8.RuneError))
+	}
+	return decoded
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// the charsets we get mail in most often that aren't utf-8, with text that
+// only survives decoding in the right one
+var testCharsets = []struct {
+	name     string
+	encoding encoding.Encoding
+	text     string
+}{
+	{"ISO-8859-1", charmap.ISO8859_1, "Grüße aus Köln, ça va?"},
+	{"Windows-1252", charmap.Windows1252, "“Smart” quotes – only €5"},
+	{"Shift_JIS", japanese.ShiftJIS, "こんにちは、世界"},
+	{"GB2312", simplifiedchinese.GBK, "你好，世界"},
+}
+
+// the body of a part in a charset and transfer encoding, 7bit can only
+// carry ascii so it gets text that's the same in every charset
+func testEncodeBody(t *testing.T, enc encoding.Encoding, text string,
+	transfer string) ([]byte, string) {
+	t.Helper()
+	if transfer == "7bit" {
+		text = "Plain ascii, see you at 10:30"
+	}
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatalf("unable to encode %q: %v", text, err)
+	}
+
+	switch transfer {
+	case "quoted-printable":
+		var buf bytes.Buffer
+		writer := quotedprintable.NewWriter(&buf)
+		_, _ = writer.Write(data)
+		_ = writer.Close()
+		data = buf.Bytes()
+	case "base64":
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	return data, text
+}
+
+var testTransferEncodings = []string{
+	"7bit", "8bit", "quoted-printable", "base64",
+}
+
+func TestDecodeHeaderText(t *testing.T) {
+	for _, cs := range testCharsets {
+		data, err := cs.encoding.NewEncoder().Bytes([]byte(cs.text))
+		if err != nil {
+			t.Fatalf("unable to encode %q: %v", cs.text, err)
+		}
+
+		b := "=?" + cs.name + "?B?" + base64.StdEncoding.EncodeToString(data) +
+			"?="
+		var q strings.Builder
+		q.WriteString("=?" + cs.name + "?Q?")
+		for _, c := range data {
+			switch {
+			case c == ' ':
+				q.WriteByte('_')
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z',
+				c >= '0' && c <= '9':
+				q.WriteByte(c)
+			default:
+				fmt.Fprintf(&q, "=%02X", c)
+			}
+		}
+		q.WriteString("?=")
+
+		for _, encoded := range []string{b, q.String()} {
+			got := decodeHeaderText("Re: " + encoded)
+			if got != "Re: "+cs.text {
+				t.Errorf("%s: decodeHeaderText(%q) = %q, want %q", cs.name,
+					encoded, got, "Re: "+cs.text)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"utf-8 as is", "Grüße", "Grüße"},
+		{"raw windows-1252", "Gr\xfc\xdfe \x80", "Grüße €"},
+		{"unknown charset left alone", "=?x-nope?Q?hi?=", "=?x-nope?Q?hi?="},
+		{"utf-8 word", "=?UTF-8?Q?caf=C3=A9?=", "café"},
+	}
+	for _, test := range tests {
+		got := decodeHeaderText(test.in)
+		if got != test.want {
+			t.Errorf("%s: decodeHeaderText(%q) = %q, want %q", test.name,
+				test.in, got, test.want)
+		}
+	}
+}
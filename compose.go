@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const (
+	composeLabelFrom     = "From:"
+	composeLabelTo       = "To:"
+	composeLabelCc       = "Cc:"
+	composeLabelBcc      = "Bcc:"
+	composeLabelSubject  = "Subject:"
+	composeLabelAttach   = "Attach:"
+	composeLabelSendAt   = "Send at:"
+	composeLabelMarkdown = "Markdown:"
+	composeLabelSign     = "Sign:"
+	composeLabelEncrypt  = "Encrypt:"
+	composeLabelSMIME    = "S/MIME Sign:"
+	composeLabelMessage  = "Message:"
+
+	attachmentWarnSizeMBDefault = 20
+)
+
+// fields that take a list of recipients
+var composeAddressLabels = []string{
+	composeLabelTo, composeLabelCc, composeLabelBcc,
+}
+
+func composeInputField(label string) *tview.InputField {
+	return g_ui.composeForm.GetFormItemByLabel(label).(*tview.InputField)
+}
+
+func composeCheckbox(label string) *tview.Checkbox {
+	return g_ui.composeForm.GetFormItemByLabel(label).(*tview.Checkbox)
+}
+
+func composeTextArea(label string) *tview.TextArea {
+	return g_ui.composeForm.GetFormItemByLabel(label).(*tview.TextArea)
+}
+
+func composeFocusTo() {
+	g_ui.composeForm.SetFocus(g_ui.composeForm.GetFormItemIndex(composeLabelTo))
+}
+
+// selects the identity in the from field, without touching the signature
+// in the message, callers set the message with the right one
+func composeSetIdentity(identity Identity) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.composeIdentity = identity
+	dropDown := g_ui.composeForm.
+		GetFormItemByLabel(composeLabelFrom).(*tview.DropDown)
+	for i, option := range identities() {
+		if option.Email == identity.Email {
+			dropDown.SetCurrentOption(i)
+		}
+	}
+}
+
+// switching identities in the from field swaps the signature too
+func onComposeIdentitySelected(_ string, index int) {
+	if index < 0 {
+		return
+	}
+	identity := identities()[index]
+	if identity.Email == g_ui.composeIdentity.Email {
+		return
+	}
+	message := composeTextArea(composeLabelMessage)
+	message.SetText(replaceSignatureBlock(
+		message.GetText(), g_ui.composeIdentity, identity), false)
+	g_ui.composeIdentity = identity
+}
+
+// zero to send right away. A time in the past is refused unless it's the
+// one the email was queued with, which passed while it was being edited, so
+// it's sent right away
+func composeSendAtParse(text string, queued string, now time.Time) (
+	time.Time, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return time.Time{}, nil
+	}
+	sendAt, err := ParseHumanTime(text, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if sendAt.Before(now) && text != queued {
+		return time.Time{}, fmt.Errorf(
+			"send at %s is in the past", FormatLocalizedTime(sendAt))
+	}
+	// "now" is the same as leaving it empty
+	if !sendAt.After(now) {
+		return time.Time{}, nil
+	}
+	return sendAt, nil
+}
+
+func composeEmailFromForm() (Email, error) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	attachments, err := composeAttachmentsFromText(
+		composeInputField(composeLabelAttach).GetText())
+	if err != nil {
+		return Email{}, fmt.Errorf("can't attach files: %v", err)
+	}
+
+	sendAt, err := composeSendAtParse(
+		composeInputField(composeLabelSendAt).GetText(),
+		g_ui.composeSendAtQueued, time.Now())
+	if err != nil {
+		return Email{}, err
+	}
+
+	addresses, label, err := composeAddressesFromForm()
+	if err != nil {
+		g_ui.composeShowAddressErrors = true
+		composeUpdateTitle()
+		g_ui.composeForm.SetFocus(g_ui.composeForm.GetFormItemIndex(label))
+		return Email{}, err
+	}
+
+	email := Email{
+		fromAddress: g_ui.composeIdentity.Email,
+		fromName:    g_ui.composeIdentity.DisplayName,
+		toAddress:   formatAddressList(addresses[composeLabelTo]),
+		ccAddress:   formatAddressList(addresses[composeLabelCc]),
+		bccAddress:  formatAddressList(addresses[composeLabelBcc]),
+		subject:     composeInputField(composeLabelSubject).GetText(),
+		body:        composeTextArea(composeLabelMessage).GetText(),
+		attachments: attachments,
+		sendAt:      sendAt,
+		markdown:    composeCheckbox(composeLabelMarkdown).IsChecked(),
+		pgpSign:     composeCheckbox(composeLabelSign).IsChecked(),
+		pgpEncrypt:  composeCheckbox(composeLabelEncrypt).IsChecked(),
+		smimeSign:   composeCheckbox(composeLabelSMIME).IsChecked(),
+	}
+
+	err = composeCheckPGP(email, addresses)
+	if err != nil {
+		return Email{}, err
+	}
+	err = composeCheckSMIME(email)
+	if err != nil {
+		return Email{}, err
+	}
+	return email, nil
+}
+
+// parses the to, cc and bcc fields keyed by label, on error also returns the
+// label of the field that's malformed
+func composeAddressesFromForm() (map[string][]*netmail.Address, string, error) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	addresses := make(map[string][]*netmail.Address)
+	count := 0
+	for _, label := range composeAddressLabels {
+		var err error
+		addresses[label], err = parseAddressList(
+			composeInputField(label).GetText())
+		if err != nil {
+			return nil, label, fmt.Errorf("invalid %s %v", label, err)
+		}
+		count += len(addresses[label])
+	}
+	if count == 0 {
+		return nil, composeLabelTo, fmt.Errorf("no recipients")
+	}
+	return addresses, "", nil
+}
+
+func composeSetFields(to, cc, subject, body string) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.composeShowAddressErrors = false
+	composeInputField(composeLabelTo).SetText(to)
+	composeInputField(composeLabelCc).SetText(cc)
+	composeInputField(composeLabelBcc).SetText("")
+	composeInputField(composeLabelSubject).SetText(subject)
+	composeInputField(composeLabelSendAt).SetText("")
+	g_ui.composeSendAtQueued = ""
+	composeCheckbox(composeLabelMarkdown).SetChecked(g_config.Markdown)
+	composeCheckbox(composeLabelSign).SetChecked(g_config.PGPSign)
+	composeCheckbox(composeLabelEncrypt).SetChecked(
+		g_config.PGPEncrypt == pgpEncryptAlways)
+	g_ui.composeEncryptTouched = false
+	composeCheckbox(composeLabelSMIME).SetChecked(g_config.SMIMESign)
+	composeApplyEncryptPolicy()
+	composeSetMarkdownPreviewVisible(false)
+	composeTextArea(composeLabelMessage).SetText(body, true)
+	composeSetAttachments(nil)
+}
+
+// reopens an email that was queued to send in compose, e.g. after undoing
+// the send or to edit it from the outbox
+func composeSetEmail(email Email) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	setUIMode(UIModeCompose)
+	composeSetFields(
+		email.toAddress, email.ccAddress, email.subject, email.body)
+	composeInputField(composeLabelBcc).SetText(email.bccAddress)
+	composeCheckbox(composeLabelMarkdown).SetChecked(email.markdown)
+	composeCheckbox(composeLabelSign).SetChecked(email.pgpSign)
+	composeCheckbox(composeLabelEncrypt).SetChecked(email.pgpEncrypt)
+	// it was already decided when the email was queued
+	g_ui.composeEncryptTouched = true
+	composeCheckbox(composeLabelSMIME).SetChecked(email.smimeSign)
+	composeSetIdentity(identityFromAddress(email.fromAddress))
+	composeSetAttachments(email.attachments)
+	if !email.sendAt.IsZero() {
+		g_ui.composeSendAtQueued = email.sendAt.Format("2006-01-02 15:04")
+		composeInputField(composeLabelSendAt).SetText(
+			g_ui.composeSendAtQueued)
+	}
+	composeFocusTo()
+	onFocusChange()
+}
+
+// lists attachments in the attach field, forwarded ones by filename, and
+// local ones by path
+func composeSetAttachments(attachments []Attachment) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.composeForwardedAttachments = g_ui.composeForwardedAttachments[:0]
+	var names []string
+	for _, attachment := range attachments {
+		if attachment.data != nil {
+			g_ui.composeForwardedAttachments = append(
+				g_ui.composeForwardedAttachments, attachment)
+			names = append(names, attachment.filename)
+		} else {
+			names = append(names, attachment.path)
+		}
+	}
+	composeInputField(composeLabelAttach).SetText(strings.Join(names, ", "))
+	composeUpdateTitle()
+}
+
+// attachment field is a comma separated list, an entry naming a forwarded
+// attachment picks that up, anything else is treated as a local file path
+func composeAttachmentsFromText(text string) ([]Attachment, error) {
+	var attachments []Attachment
+	var errs []string
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		forwarded := false
+		for _, attachment := range g_ui.composeForwardedAttachments {
+			if attachment.filename == entry {
+				attachments = append(attachments, attachment)
+				forwarded = true
+				break
+			}
+		}
+		if forwarded {
+			continue
+		}
+
+		path := expandHomeDir(entry)
+		info, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", entry, err))
+			continue
+		}
+		if info.IsDir() {
+			errs = append(errs, fmt.Sprintf("%s: is a directory", entry))
+			continue
+		}
+		attachments = append(attachments, Attachment{
+			filename: filepath.Base(path),
+			size:     info.Size(),
+			path:     path,
+		})
+	}
+
+	if len(errs) > 0 {
+		return attachments, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return attachments, nil
+}
+
+// the title shows attachment count and size, and problems with the form,
+// address errors only once a send was refused so they don't flag half typed
+// addresses
+func composeUpdateTitle() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	attachments, err := composeAttachmentsFromText(
+		composeInputField(composeLabelAttach).GetText())
+
+	total := int64(0)
+	for _, attachment := range attachments {
+		total += attachment.size
+	}
+
+	warnSizeMB := g_config.AttachmentWarnSizeMB
+	if warnSizeMB == 0 {
+		warnSizeMB = attachmentWarnSizeMBDefault
+	}
+
+	title := "Compose"
+	co := tcell.GetColor(coSelectionFocused)
+	if len(attachments) > 0 {
+		title = fmt.Sprintf("Compose (%d attachments, %s)",
+			len(attachments), FormatHumanReadableSize(total))
+	}
+	if total > int64(warnSizeMB)*1024*1024 {
+		title += fmt.Sprintf(
+			" over %d mb, may be rejected by recipients", warnSizeMB)
+		co = tcell.GetColor(coWarningText)
+	}
+	if err != nil {
+		title += fmt.Sprintf(" %v", err)
+		co = tcell.GetColor(coWarningText)
+	}
+	if g_ui.composeShowAddressErrors {
+		_, _, err := composeAddressesFromForm()
+		if err != nil {
+			title += fmt.Sprintf(" %v", err)
+			co = tcell.GetColor(coWarningText)
+		}
+	}
+	g_ui.composeForm.SetTitle(title)
+	g_ui.composeForm.SetTitleColor(co)
+}
+
+// completes the last comma separated entry of the attach field against the
+// file system, keeping the entries before it
+func composeCompleteAttachmentPath(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	prefix, entry := "", text
+	if i := strings.LastIndex(text, ","); i != -1 {
+		prefix, entry = text[:i+1]+" ", strings.TrimSpace(text[i+1:])
+	}
+	if entry == "" {
+		return nil
+	}
+
+	dir, base := filepath.Split(entry)
+	dirEntries, err := os.ReadDir(expandHomeDir(dir + "."))
+	if err != nil {
+		return nil
+	}
+
+	var entries []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if dirEntry.IsDir() {
+			name += string(filepath.Separator)
+		}
+		entries = append(entries, prefix+dir+name)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func expandHomeDir(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComposeSendAtParse(t *testing.T) {
+	now := time.Date(2026, 10, 21, 14, 30, 0, 0, time.Local)
+	queued := "2026-10-21 14:00"
+	tests := []struct {
+		text   string
+		queued string
+		want   time.Time
+	}{
+		{"", "", time.Time{}},
+		{"now", "", time.Time{}},
+		{"+1h", "", now.Add(time.Hour)},
+		{"2026-10-21 15:00", queued, time.Date(2026, 10, 21, 15, 0, 0, 0,
+			time.Local)},
+		// queued for 14:00, which passed while it was being edited
+		{queued, queued, time.Time{}},
+		{" " + queued + " ", queued, time.Time{}},
+	}
+	for _, test := range tests {
+		got, err := composeSendAtParse(test.text, test.queued, now)
+		if err != nil {
+			t.Errorf("composeSendAtParse(%q, %q): %v", test.text, test.queued,
+				err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("composeSendAtParse(%q, %q) = %v, want %v", test.text,
+				test.queued, got, test.want)
+		}
+	}
+
+	for _, test := range []struct{ text, queued string }{
+		{queued, ""},
+		{"2026-10-21 13:00", queued},
+		{"tomorrow 25:00", ""},
+	} {
+		got, err := composeSendAtParse(test.text, test.queued, now)
+		if err == nil {
+			t.Errorf("composeSendAtParse(%q, %q) = %v, want an error",
+				test.text, test.queued, got)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/rivo/tview"
+)
+
+const (
+	contactsSaveInterval   = 30 * time.Second
+	contactsCompletionsMax = 10
+	// emails we sent to someone count this many times more than ones we got
+	contactsSentWeight = 3
+	// how many days until a contact's score has halved from not being seen
+	contactsRecencyHalfLifeDays = 30
+	// message ids of the most recent emails kept to not harvest them twice
+	contactsMessageIdsMax = 20000
+)
+
+type Contact struct {
+	Address   string
+	Name      string
+	Count     int
+	SentCount int
+	LastSeen  time.Time
+	// contacts from vcard files rank as if we've seen them once
+	Imported bool `json:",omitempty"`
+}
+
+// persisted as contacts.json, message ids we've already harvested are kept
+// with the date of their email so refetching envelopes on every start
+// doesn't inflate counts. Only the most recent ones are kept, emails from
+// before HarvestedBefore are taken as harvested already
+type ContactsStore struct {
+	Contacts        map[string]*Contact
+	MessageIdDates  map[string]time.Time
+	HarvestedBefore time.Time `json:",omitempty"`
+}
+
+var (
+	g_contactsMu    sync.Mutex
+	g_contacts      ContactsStore
+	g_contactsDirty bool
+)
+
+func contactsInit() {
+	g_contacts = ContactsStore{
+		Contacts:       make(map[string]*Contact),
+		MessageIdDates: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(dataFilePath("contacts.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &g_contacts)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to load contacts: %v", err)
+	}
+	if g_contacts.Contacts == nil {
+		g_contacts.Contacts = make(map[string]*Contact)
+	}
+	if g_contacts.MessageIdDates == nil {
+		g_contacts.MessageIdDates = make(map[string]time.Time)
+	}
+
+	for _, path := range g_config.VCardFiles {
+		err := contactsImportVCard(expandHomeDir(path))
+		if err != nil {
+			log.Printf("unable to import contacts from \"%s\": %v", path, err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(contactsSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			contactsSave()
+		}
+	}()
+}
+
+func contactsSave() {
+	g_contactsMu.Lock()
+	defer g_contactsMu.Unlock()
+	if !g_contactsDirty {
+		return
+	}
+	contactsPruneMessageIdsLocked()
+	data, err := json.Marshal(&g_contacts)
+	if err == nil {
+		err = writeFileAtomic(dataFilePath("contacts.json"), data)
+	}
+	if err != nil {
+		log.Printf("unable to save contacts: %v", err)
+		return
+	}
+	g_contactsDirty = false
+}
+
+func contactsAddLocked(address, name string, date time.Time, sent bool) {
+	Assert(g_contactsMu.TryLock() == false, "g_contactsMu needs to be locked")
+	address = strings.TrimSpace(address)
+	if address == "" || !strings.Contains(address, "@") {
+		return
+	}
+	key := strings.ToLower(address)
+	contact, ok := g_contacts.Contacts[key]
+	if !ok {
+		contact = &Contact{Address: address}
+		g_contacts.Contacts[key] = contact
+	}
+	if name != "" {
+		contact.Name = name
+	}
+	if sent {
+		contact.SentCount++
+	} else {
+		contact.Count++
+	}
+	if date.After(contact.LastSeen) {
+		contact.LastSeen = date
+	}
+	g_contactsDirty = true
+}
+
+// harvests senders and recipients of an email as it's downloaded
+func contactsHarvestEnvelope(envelope *imap.Envelope) {
+	if envelope == nil || g_contacts.Contacts == nil {
+		return
+	}
+
+	g_contactsMu.Lock()
+	defer g_contactsMu.Unlock()
+	if envelope.MessageId != "" {
+		_, ok := g_contacts.MessageIdDates[envelope.MessageId]
+		if ok || (!g_contacts.HarvestedBefore.IsZero() &&
+			envelope.Date.Before(g_contacts.HarvestedBefore)) {
+			return
+		}
+		g_contacts.MessageIdDates[envelope.MessageId] = envelope.Date
+	}
+
+	for _, addresses := range [][]*imap.Address{
+		envelope.From, envelope.To, envelope.Cc,
+	} {
+		for _, address := range addresses {
+			if identityIsOurs(address.Address()) {
+				continue
+			}
+			contactsAddLocked(address.Address(),
+				decodeHeaderText(address.PersonalName), envelope.Date, false)
+		}
+	}
+}
+
+// drops the message ids of the oldest emails past contactsMessageIdsMax
+func contactsPruneMessageIdsLocked() {
+	Assert(g_contactsMu.TryLock() == false, "g_contactsMu needs to be locked")
+	n := len(g_contacts.MessageIdDates) - contactsMessageIdsMax
+	if n <= 0 {
+		return
+	}
+	dates := make([]time.Time, 0, len(g_contacts.MessageIdDates))
+	for _, date := range g_contacts.MessageIdDates {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	// emails from the same time as the last one dropped go too
+	cutoff := dates[n-1].Add(time.Nanosecond)
+	for messageId, date := range g_contacts.MessageIdDates {
+		if date.Before(cutoff) {
+			delete(g_contacts.MessageIdDates, messageId)
+		}
+	}
+	if cutoff.After(g_contacts.HarvestedBefore) {
+		g_contacts.HarvestedBefore = cutoff
+	}
+}
+
+// harvests recipients of an email we sent
+func contactsHarvestSent(email Email) {
+	g_contactsMu.Lock()
+	defer g_contactsMu.Unlock()
+	for _, field := range []string{
+		email.toAddress, email.ccAddress, email.bccAddress,
+	} {
+		// malformed entries were caught in compose, skip any that remain
+		addresses, _ := parseAddressList(field)
+		for _, address := range addresses {
+			contactsAddLocked(address.Address, address.Name, time.Now(), true)
+		}
+	}
+}
+
+// a minimal vcard reader for FN and EMAIL properties, good enough for
+// exports from the usual address books
+func contactsImportVCard(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// unfold continuation lines first, they start with a space or tab
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") ||
+			strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	g_contactsMu.Lock()
+	defer g_contactsMu.Unlock()
+	name := ""
+	var addresses []string
+	for _, line := range lines {
+		property, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		property, _, _ = strings.Cut(strings.ToUpper(property), ";")
+		// properties may be grouped, e.g. item1.EMAIL
+		if i := strings.LastIndex(property, "."); i != -1 {
+			property = property[i+1:]
+		}
+
+		switch property {
+		case "BEGIN":
+			name, addresses = "", nil
+		case "FN":
+			name = strings.ReplaceAll(value, "\\,", ",")
+		case "EMAIL":
+			addresses = append(addresses, value)
+		case "END":
+			for _, address := range addresses {
+				key := strings.ToLower(strings.TrimSpace(address))
+				if _, ok := g_contacts.Contacts[key]; ok {
+					continue
+				}
+				g_contacts.Contacts[key] = &Contact{
+					Address:  strings.TrimSpace(address),
+					Name:     name,
+					Imported: true,
+				}
+				g_contactsDirty = true
+			}
+		}
+	}
+	return nil
+}
+
+func (contact *Contact) score(now time.Time) float64 {
+	count := float64(contact.Count + contact.SentCount*contactsSentWeight)
+	if contact.Imported && count == 0 {
+		count = 1
+	}
+	days := now.Sub(contact.LastSeen).Hours() / 24
+	if contact.LastSeen.IsZero() {
+		days = 365
+	}
+	return count * math.Pow(0.5, days/contactsRecencyHalfLifeDays)
+}
+
+// contacts whose name or address contains query, best first
+func contactsSearch(query string) []Contact {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil
+	}
+
+	g_contactsMu.Lock()
+	defer g_contactsMu.Unlock()
+	now := time.Now()
+	var contacts []Contact
+	scores := make(map[string]float64)
+	for key, contact := range g_contacts.Contacts {
+		if !strings.Contains(key, query) &&
+			!strings.Contains(strings.ToLower(contact.Name), query) {
+			continue
+		}
+		contacts = append(contacts, *contact)
+		scores[contact.Address] = contact.score(now)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return scores[contacts[i].Address] > scores[contacts[j].Address]
+	})
+	return contacts[:min(len(contacts), contactsCompletionsMax)]
+}
+
+func (contact Contact) String() string {
+	if contact.Name == "" {
+		return contact.Address
+	}
+	name := contact.Name
+	if strings.ContainsAny(name, ",;:<>@\"()[]\\.") {
+		name = `"` + strings.ReplaceAll(name, `"`, `\"`) + `"`
+	}
+	return name + " <" + contact.Address + ">"
+}
+
+// completes the last comma separated address of a to/cc field, keeping the
+// addresses before it
+func contactsCompleteAddressField(text string) []string {
+	prefix, query := "", text
+	if i := strings.LastIndex(text, ","); i != -1 {
+		prefix, query = text[:i+1]+" ", text[i+1:]
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil
+	}
+
+	var entries []string
+	for _, contact := range contactsSearch(query) {
+		entries = append(entries, prefix+contact.String())
+	}
+	return entries
+}
+
+// picking a completion leaves the field ready for the next address
+func onContactsAddressAutocompleted(
+	field *tview.InputField,
+) func(text string, index int, source int) bool {
+	return func(text string, index int, source int) bool {
+		if source == tview.AutocompletedNavigate {
+			return false
+		}
+		field.SetText(text + ", ")
+		return true
+	}
+}
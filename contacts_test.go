@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func testEnvelope(messageId string, date time.Time) *imap.Envelope {
+	return &imap.Envelope{
+		MessageId: messageId,
+		Date:      date,
+		From: []*imap.Address{{PersonalName: "Bob", MailboxName: "bob",
+			HostName: "example.com"}},
+	}
+}
+
+func TestContactsHarvestOnce(t *testing.T) {
+	testModelInit(t)
+	contactsInit()
+	date := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+
+	contactsHarvestEnvelope(testEnvelope("<1@example.com>", date))
+	contactsHarvestEnvelope(testEnvelope("<1@example.com>", date))
+	if count := g_contacts.Contacts["bob@example.com"].Count; count != 1 {
+		t.Errorf("harvested the same email %d times", count)
+	}
+}
+
+func TestContactsPruneMessageIds(t *testing.T) {
+	testModelInit(t)
+	contactsInit()
+	minute := func(i int) time.Time {
+		return time.Date(2026, 1, 1, 0, i, 0, 0, time.UTC)
+	}
+	n := contactsMessageIdsMax + 10
+	for i := 0; i < n; i++ {
+		contactsHarvestEnvelope(testEnvelope(
+			fmt.Sprintf("<%d@example.com>", i), minute(i)))
+	}
+	contactsSave()
+
+	if len(g_contacts.MessageIdDates) != contactsMessageIdsMax {
+		t.Errorf("kept %d message ids, want %d",
+			len(g_contacts.MessageIdDates), contactsMessageIdsMax)
+	}
+	if _, ok := g_contacts.MessageIdDates["<0@example.com>"]; ok {
+		t.Errorf("the oldest message id wasn't dropped")
+	}
+
+	// the oldest emails are fetched again, their ids are gone but they still
+	// aren't counted twice
+	for i := 0; i < 10; i++ {
+		contactsHarvestEnvelope(testEnvelope(
+			fmt.Sprintf("<%d@example.com>", i), minute(i)))
+	}
+	if count := g_contacts.Contacts["bob@example.com"].Count; count != n {
+		t.Errorf("bob counted %d times, want %d", count, n)
+	}
+
+	// reloaded the way they were saved
+	contactsInit()
+	if len(g_contacts.MessageIdDates) != contactsMessageIdsMax ||
+		g_contacts.HarvestedBefore.IsZero() {
+		t.Errorf("message ids weren't saved pruned")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func emailFilterActive() bool {
+	return g_ui.filterText != "" || g_ui.filterUnread || g_ui.filterFlagged ||
+		g_ui.filterAttachments
+}
+
+// every word of the filter has to be in the sender, subject or body, bodies
+// are only searched while they're in memory, and attachments are only known
+// for emails that were viewed or prefetched
+func emailMatchesFilter(email Email) bool {
+	if g_ui.filterUnread && email.isRead {
+		return false
+	}
+	if g_ui.filterFlagged && !email.isFlagged {
+		return false
+	}
+	if g_ui.filterAttachments && !email.hasAttachments {
+		return false
+	}
+
+	sender := strings.ToLower(email.fromName + " " + email.fromAddress)
+	subject := strings.ToLower(email.subject)
+	var body string
+	for _, word := range strings.Fields(strings.ToLower(g_ui.filterText)) {
+		if strings.Contains(sender, word) || strings.Contains(subject, word) {
+			continue
+		}
+		if body == "" {
+			body = strings.ToLower(email.body)
+		}
+		if !strings.Contains(body, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuilds the table from the underlying list with the rows that match the
+// filter, selecting selectUid when it is one of them
+func emailsTableShowRows(selectUid uint32) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := g_ui.folderSelected
+	g_ui.emailsTable.Clear()
+	g_ui.emailsUidList = g_ui.emailsUidList[:0]
+	selectedRow := 0
+	for _, uid := range g_ui.emailsUidListAll {
+		email := cachedEmailFromUid(folder, uid)
+		if !emailMatchesFilter(email) {
+			continue
+		}
+		if uid == selectUid {
+			selectedRow = len(g_ui.emailsUidList)
+		}
+		updateImapEmailInTable(len(g_ui.emailsUidList), email)
+		g_ui.emailsUidList = append(g_ui.emailsUidList, uid)
+	}
+	if len(g_ui.emailsUidList) > 0 {
+		g_ui.emailsTable.Select(selectedRow, 0)
+	}
+	updateEmailStatusBarWithSelection()
+}
+
+func emailsTableSelectedUid() uint32 {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	row, _ := g_ui.emailsTable.GetSelection()
+	if row < len(g_ui.emailsUidList) {
+		return g_ui.emailsUidList[row]
+	}
+	return 0
+}
+
+func filterSetLabel() {
+	var toggles []string
+	if g_ui.filterUnread {
+		toggles = append(toggles, "unread")
+	}
+	if g_ui.filterFlagged {
+		toggles = append(toggles, "flagged")
+	}
+	if g_ui.filterAttachments {
+		toggles = append(toggles, "attachments")
+	}
+	label := "Filter: "
+	if len(toggles) > 0 {
+		label = fmt.Sprintf("Filter (%s): ", strings.Join(toggles, ", "))
+	}
+	g_ui.filterInput.SetLabel(label)
+}
+
+func filterSetVisible(visible bool) {
+	height := 0
+	if visible {
+		height = 1
+	}
+	g_ui.emailsPane.ResizeItem(g_ui.filterInput, height, 0)
+}
+
+func filterApply() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	filterSetLabel()
+	emailsTableShowRows(emailsTableSelectedUid())
+}
+
+// opens the filter bar over the emails table, the rows narrow as you type
+func filterShow() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderSelected == outboxFolder {
+		updateStatusBar("The outbox can't be filtered")
+		return
+	}
+	if !emailFilterActive() {
+		g_ui.filterUidBefore = emailsTableSelectedUid()
+	}
+	filterSetLabel()
+	filterSetVisible(true)
+	g_ui.mode = UIModeFilter
+	g_ui.app.SetFocus(g_ui.filterInput)
+	onFocusChange()
+	setHintsBarText()
+}
+
+func onFilterChanged(text string) {
+	if text == g_ui.filterText {
+		return
+	}
+	g_ui.filterText = text
+	filterApply()
+}
+
+func filterToggle(toggle *bool) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	*toggle = !*toggle
+	filterApply()
+}
+
+// back to the emails table, keeping the filter while it narrows anything
+func filterClose() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.mode = UIModeNormal
+	if !emailFilterActive() {
+		filterSetVisible(false)
+	}
+	g_ui.app.SetFocus(g_ui.emailsTable)
+	onFocusChange()
+	setHintsBarText()
+}
+
+// drops the filter, showing every row again with the email that was
+// selected before filtering selected again
+func filterClear() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	selectUid := g_ui.filterUidBefore
+	if selectUid == 0 {
+		selectUid = emailsTableSelectedUid()
+	}
+	filterReset()
+	emailsTableShowRows(selectUid)
+	filterClose()
+}
+
+// forgets the filter without touching the table, e.g. switching folders
+func filterReset() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.filterText = ""
+	g_ui.filterUnread = false
+	g_ui.filterFlagged = false
+	g_ui.filterAttachments = false
+	g_ui.filterUidBefore = 0
+	g_ui.filterInput.SetText("")
+	filterSetLabel()
+	filterSetVisible(false)
+}
+
+func filterKeyHandler(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyEnter, tcell.KeyTab:
+		filterClose()
+		return nil
+	case tcell.KeyEsc:
+		filterClear()
+		return nil
+	case tcell.KeyCtrlU:
+		filterToggle(&g_ui.filterUnread)
+		return nil
+	case tcell.KeyCtrlF:
+		filterToggle(&g_ui.filterFlagged)
+		return nil
+	case tcell.KeyCtrlT:
+		filterToggle(&g_ui.filterAttachments)
+		return nil
+	}
+	return event
+}
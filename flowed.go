@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+)
+
+// rfc 3676 format=flowed, a line ending in a space is soft broken and
+// continues on the next line, so recipients can reflow paragraphs to their
+// own width. Lines are wrapped to flowedLineWidth, but only once they're
+// longer than flowedLineMax so quotes of already wrapped text aren't left
+// with a word dangling on every other line
+const (
+	flowedLineWidth = 72
+	flowedLineMax   = 78
+)
+
+// splits a flowed line into its quote depth and content, quote marks are
+// ">" without spaces between them per the rfc
+func flowedQuoteDepth(line string) (int, string) {
+	depth := 0
+	for depth < len(line) && line[depth] == '>' {
+		depth++
+	}
+	return depth, line[depth:]
+}
+
+func flowedEncode(text string) string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == signatureDelimiter {
+			out = append(out, line)
+			continue
+		}
+
+		// trailing spaces would turn a hard break into a soft one
+		depth, rest := quoteDepth(strings.TrimRight(line, " "))
+		prefix := strings.Repeat(">", depth)
+		// space stuffing, a space after the quote marks is always stuffed so
+		// "> text" comes out as it was written
+		if depth > 0 || strings.HasPrefix(rest, " ") ||
+			strings.HasPrefix(rest, ">") || strings.HasPrefix(rest, "From ") {
+			prefix += " "
+		}
+
+		if len(prefix)+len(rest) <= flowedLineMax {
+			out = append(out, prefix+rest)
+			continue
+		}
+
+		// soft breaks keep the space between words at the end of the line
+		words := strings.SplitAfter(rest, " ")
+		current := ""
+		for _, word := range words {
+			if current != "" &&
+				len(prefix)+len(current)+len(strings.TrimRight(word, " ")) >
+					flowedLineWidth {
+				out = append(out, prefix+current)
+				current = ""
+			}
+			current += word
+		}
+		out = append(out, prefix+current)
+	}
+	return strings.Join(out, "\n")
+}
+
+// joins soft broken lines back into paragraphs, quoted ones are shown with
+// the usual "> " prefix per level
+func flowedDecode(text string, delSp bool) string {
+	var out []string
+	paragraph := ""
+	paragraphDepth := -1
+
+	flush := func() {
+		if paragraphDepth == -1 {
+			return
+		}
+		out = append(out, quotePrefix(paragraphDepth)+paragraph)
+		paragraph = ""
+		paragraphDepth = -1
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		depth, rest := flowedQuoteDepth(line)
+		rest = strings.TrimPrefix(rest, " ") // unstuff
+
+		// a change in quote depth ends a paragraph even after a soft break
+		if depth != paragraphDepth {
+			flush()
+		}
+
+		soft := strings.HasSuffix(rest, " ") && rest != signatureDelimiter
+		if soft && delSp {
+			rest = strings.TrimSuffix(rest, " ")
+		}
+		paragraph += rest
+		paragraphDepth = depth
+		if !soft {
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(out, "\n")
+}
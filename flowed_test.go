@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFlowedEncode(t *testing.T) {
+	long := strings.Repeat("word ", 20) + "end"
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"short lines are left alone", "hello\nworld", "hello\nworld"},
+		{"space stuffing", "From here\n leading space\nplain",
+			" From here\n  leading space\nplain"},
+		{"trailing spaces don't make a soft break", "hard  \nbreak",
+			"hard\nbreak"},
+		{"signature separator keeps its space", "text\n-- \nBob",
+			"text\n-- \nBob"},
+		{"quotes are stuffed", "> quoted\n>> deeper", "> quoted\n>> deeper"},
+		{"long lines are soft broken",
+			long,
+			strings.Repeat("word ", 14) + "\n" +
+				strings.Repeat("word ", 6) + "end"},
+		{"long quoted lines are soft broken within the quote",
+			"> " + long,
+			"> " + strings.Repeat("word ", 14) + "\n" +
+				"> " + strings.Repeat("word ", 6) + "end"},
+	}
+	for _, test := range tests {
+		if got := flowedEncode(test.text); got != test.want {
+			t.Errorf("%s: flowedEncode(%q) = %q, want %q", test.name,
+				test.text, got, test.want)
+		}
+	}
+}
+
+func TestFlowedDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		delSp bool
+		want  string
+	}{
+		{"soft breaks join", "one \ntwo \nthree\nfour", false,
+			"one two three\nfour"},
+		{"delsp drops the soft break space", "super\r\ncali \r\nfragile", true,
+			"super\ncalifragile"},
+		{"unstuffing", " From here\n  leading space", false,
+			"From here\n leading space"},
+		{"quoted paragraphs", "> one \n> two\n>> three \n>> four\nend", false,
+			"> one two\n>> three four\nend"},
+		{"a change of quote depth ends a paragraph", "> one \n>> two", false,
+			"> one \n>> two"},
+		{"signature separator isn't a soft break", "text\n-- \nBob", false,
+			"text\n-- \nBob"},
+	}
+	for _, test := range tests {
+		got := flowedDecode(test.text, test.delSp)
+		if got != test.want {
+			t.Errorf("%s: flowedDecode(%q, %v) = %q, want %q", test.name,
+				test.text, test.delSp, got, test.want)
+		}
+	}
+}
+
+func TestFlowedRoundTrip(t *testing.T) {
+	long := strings.Repeat("a fairly long sentence that keeps going ", 5)
+	for _, text := range []string{
+		"hello\n\nworld",
+		"From the start\n>not a quote in flowed terms\n indented",
+		strings.TrimSpace(long),
+		"> " + strings.TrimSpace(long) + "\n\nreply",
+		">> deeper\n> shallower\nnone",
+		"body\n-- \nBob\nexample.com",
+	} {
+		got := flowedDecode(flowedEncode(text), false)
+		want := text
+		if strings.HasPrefix(text, "From the start") {
+			// quote marks without a space are quotes once sent
+			want = "From the start\n> not a quote in flowed terms\n indented"
+		}
+		if got != want {
+			t.Errorf("round trip of %q = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rivo/tview"
+)
+
+// a folder on the server, and whether we're subscribed to it. Only
+// subscribed folders are in the folders pane unless all of them are shown
+type FolderItem struct {
+	name       string
+	delimiter  string
+	subscribed bool
+}
+
+func imapListNames(list func(chan *imap.MailboxInfo) error) (
+	[]*imap.MailboxInfo, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- list(mailboxes)
+	}()
+	var infos []*imap.MailboxInfo
+	for mailbox := range mailboxes {
+		infos = append(infos, mailbox)
+	}
+	return infos, <-done
+}
+
+// every folder from LIST, with LSUB telling which ones are subscribed
+func imapListFolders(clt *client.Client) ([]FolderItem, error) {
+	subscribedInfos, err := imapListNames(
+		func(ch chan *imap.MailboxInfo) error {
+			return clt.Lsub("" /* base folder hierarchy */, "*", ch)
+		})
+	if err != nil {
+		return nil, err
+	}
+	subscribed := make(map[string]bool)
+	for _, info := range subscribedInfos {
+		subscribed[getNormalizedImapFolderName(info.Name)] = true
+	}
+
+	infos, err := imapListNames(func(ch chan *imap.MailboxInfo) error {
+		return clt.List("" /* base folder hierarchy */, "*", ch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var folders []FolderItem
+	for _, info := range infos {
+		name := getNormalizedImapFolderName(info.Name)
+		folders = append(folders, FolderItem{
+			name:       name,
+			delimiter:  info.Delimiter,
+			subscribed: subscribed[name],
+		})
+	}
+	return folders, nil
+}
+
+func notifyFolderListFetched(folders []FolderItem) {
+	g_ui.app.QueueUpdateDraw(func() {
+		g_ui.folders = folders
+		foldersListRender()
+	})
+}
+
+func showOutboxInFoldersList() {
+	g_ui.app.QueueUpdateDraw(func() {
+		g_ui.foldersOutboxShown = true
+		foldersListRender()
+	})
+}
+
+// rebuilds the folders pane, the inbox is always there, and unsubscribed
+// folders are dimmed when all of them are shown
+func foldersListRender() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	current := foldersListCurrent()
+	g_ui.foldersList.Clear()
+	g_ui.foldersShown = g_ui.foldersShown[:0]
+	for _, folder := range g_ui.folders {
+		if !g_ui.foldersShowAll && !folder.subscribed &&
+			folder.name != imapIdleFolder {
+			continue
+		}
+		text := folder.name
+		if !folder.subscribed {
+			text = fmt.Sprintf("[%s]%s", coEmailRead, tview.Escape(text))
+		}
+		g_ui.foldersList.AddItem(text, "", 0, nil)
+		g_ui.foldersShown = append(g_ui.foldersShown, folder.name)
+	}
+	if g_ui.foldersOutboxShown {
+		g_ui.foldersList.AddItem(outboxFolderTitle, "", 0, nil)
+		g_ui.foldersShown = append(g_ui.foldersShown, outboxFolder)
+	}
+
+	if i := slices.Index(g_ui.foldersShown, current); i != -1 {
+		g_ui.foldersList.SetCurrentItem(i)
+	}
+	title := "Folders"
+	if g_ui.foldersShowAll {
+		title = "All Folders"
+	}
+	g_ui.foldersList.SetTitle(title)
+}
+
+func foldersListCurrent() string {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	i := g_ui.foldersList.GetCurrentItem()
+	if i < 0 || i >= len(g_ui.foldersShown) {
+		return ""
+	}
+	return g_ui.foldersShown[i]
+}
+
+func folderItemIndex(name string) int {
+	return slices.IndexFunc(g_ui.folders, func(folder FolderItem) bool {
+		return folder.name == name
+	})
+}
+
+// the folder picked in the folders pane, when it's one on the server that
+// can be changed
+func folderForChange(action string) (string, bool) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := foldersListCurrent()
+	if folder == "" || folder == outboxFolder {
+		updateStatusBar("No folder selected to " + action)
+		return "", false
+	}
+	if folder == imapIdleFolder && action != "subscribe to" {
+		updateStatusBar(fmt.Sprintf("Can't %s the %s", action, folder))
+		return "", false
+	}
+	return folder, true
+}
+
+func foldersToggleShowAll() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.foldersShowAll = !g_ui.foldersShowAll
+	foldersListRender()
+	if g_ui.foldersShowAll {
+		updateStatusBar("Showing all folders, unsubscribed ones dimmed")
+	} else {
+		updateStatusBar("Showing subscribed folders")
+	}
+}
+
+// new folders are subscribed to so they show up
+func folderCreatePrompt() {
+	showPrompt("New folder:", "e.g. Projects/2026", func(text string) {
+		name := strings.TrimSpace(text)
+		if name == "" {
+			return
+		}
+		go func() {
+			err := imapCommand("", func(clt *client.Client) error {
+				err := clt.Create(name)
+				if err != nil {
+					return err
+				}
+				return clt.Subscribe(name)
+			})
+			if err != nil {
+				updateStatusBar(fmt.Sprintf(
+					"Unable to create folder %s: %v", name, err))
+				return
+			}
+			g_ui.app.QueueUpdateDraw(func() {
+				if folderItemIndex(name) == -1 {
+					g_ui.folders = append(g_ui.folders,
+						FolderItem{name: name, subscribed: true})
+				}
+				foldersListRender()
+				updateStatusBar("Created folder " + name)
+			})
+		}()
+	})
+}
+
+// the subscription goes along with the name, and folders under it are
+// renamed too
+func folderRenamePrompt() {
+	folder, ok := folderForChange("rename")
+	if !ok {
+		return
+	}
+	showPrompt(fmt.Sprintf("Rename %s to:", folder), folder,
+		func(text string) {
+			name := strings.TrimSpace(text)
+			if name == "" || name == folder {
+				return
+			}
+			i := folderItemIndex(folder)
+			subscribed := i != -1 && g_ui.folders[i].subscribed
+			go folderRename(folder, name, subscribed)
+		})
+}
+
+func folderRename(folder string, name string, subscribed bool) {
+	err := imapCommand("", func(clt *client.Client) error {
+		err := clt.Rename(folder, name)
+		if err != nil {
+			return err
+		}
+		if subscribed {
+			// not every server moves subscriptions along
+			_ = clt.Unsubscribe(folder)
+			return clt.Subscribe(name)
+		}
+		return nil
+	})
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Unable to rename folder %s: %v",
+			folder, err))
+		return
+	}
+
+	g_ui.app.QueueUpdateDraw(func() {
+		// the folder and those under it, whether shown, cached or with a
+		// sort order, all go by their new names
+		current := foldersListCurrent()
+		selected := ""
+		delimiter := ""
+		if i := folderItemIndex(folder); i != -1 {
+			delimiter = g_ui.folders[i].delimiter
+		}
+		for i, item := range g_ui.folders {
+			renamed, ok := folderRenamed(item.name, folder, name,
+				item.delimiter)
+			if !ok {
+				continue
+			}
+			if item.name == g_ui.folderSelected {
+				selected = renamed
+			}
+			if item.name == current {
+				current = renamed
+			}
+			folderForget(item.name)
+			g_ui.folders[i].name = renamed
+		}
+		cachedEmailSortRenameFolder(folder, name, delimiter)
+		foldersListRender()
+		if i := slices.Index(g_ui.foldersShown, current); i != -1 {
+			g_ui.foldersList.SetCurrentItem(i)
+		}
+		updateStatusBar(fmt.Sprintf("Renamed folder %s to %s", folder, name))
+		if selected != "" {
+			go fetchFolder(selected, fetchFolderOptionAllEmails)
+		} else if g_ui.folderSelected == "" {
+			go fetchFolder(name, fetchFolderOptionAllEmails)
+		}
+	})
+}
+
+// the name of a folder once folder is renamed to name, false when it's
+// neither folder nor under it
+func folderRenamed(item string, folder string, name string,
+	delimiter string) (string, bool) {
+	if item == folder {
+		return name, true
+	}
+	if delimiter != "" && strings.HasPrefix(item, folder+delimiter) {
+		return name + strings.TrimPrefix(item, folder), true
+	}
+	return "", false
+}
+
+func folderDeletePrompt() {
+	folder, ok := folderForChange("delete")
+	if !ok {
+		return
+	}
+	showPrompt(fmt.Sprintf("Delete %s and all its emails?", folder),
+		"type yes to delete", func(text string) {
+			if strings.TrimSpace(text) != "yes" {
+				updateStatusBar("Folder not deleted")
+				return
+			}
+			go folderDelete(folder)
+		})
+}
+
+func folderDelete(folder string) {
+	err := imapCommand("", func(clt *client.Client) error {
+		// fails when it wasn't subscribed to, which is fine
+		_ = clt.Unsubscribe(folder)
+		return clt.Delete(folder)
+	})
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Unable to delete folder %s: %v",
+			folder, err))
+		return
+	}
+
+	g_ui.app.QueueUpdateDraw(func() {
+		folderForget(folder)
+		if i := folderItemIndex(folder); i != -1 {
+			g_ui.folders = slices.Delete(g_ui.folders, i, i+1)
+		}
+		foldersListRender()
+		updateStatusBar("Deleted folder " + folder)
+		if g_ui.folderSelected == "" {
+			go fetchFolder(imapIdleFolder, fetchFolderOptionAllEmails)
+		}
+	})
+}
+
+// drops the cached emails of a folder that's gone, emptying the table first
+// when it's the one shown, which leaves no folder selected
+func folderForget(folder string) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderSelected == folder {
+		if g_ui.folderDownloadCancel != nil {
+			g_ui.folderDownloadCancel()
+		}
+		g_ui.emailsTable.Clear()
+		g_ui.emailsUidList = g_ui.emailsUidList[:0]
+		g_ui.emailsUidListAll = g_ui.emailsUidListAll[:0]
+		g_ui.markedUids = make(map[uint32]bool)
+		g_ui.markAnchorUid = 0
+		filterReset()
+		g_ui.folderSelected = ""
+		g_ui.folderItemCount = 0
+		g_ui.previewUid = 0
+		g_ui.previewText.SetTitle("Preview")
+		g_ui.previewText.SetText("", false)
+	}
+	cachedEmailFolderClear(folder)
+}
+
+func folderToggleSubscribed() {
+	folder, ok := folderForChange("subscribe to")
+	if !ok {
+		return
+	}
+	i := folderItemIndex(folder)
+	if i == -1 {
+		return
+	}
+	subscribe := !g_ui.folders[i].subscribed
+	go func() {
+		err := imapCommand("", func(clt *client.Client) error {
+			if subscribe {
+				return clt.Subscribe(folder)
+			}
+			return clt.Unsubscribe(folder)
+		})
+		if err != nil {
+			updateStatusBar(fmt.Sprintf(
+				"Unable to change subscription to %s: %v", folder, err))
+			return
+		}
+		g_ui.app.QueueUpdateDraw(func() {
+			if i := folderItemIndex(folder); i != -1 {
+				g_ui.folders[i].subscribed = subscribe
+			}
+			foldersListRender()
+			if subscribe {
+				updateStatusBar("Subscribed to " + folder)
+			} else {
+				updateStatusBar("Unsubscribed from " + folder)
+			}
+		})
+	}()
+}
@@ -11,6 +11,9 @@ const (
 	UIModeNormal = iota
 	UIModeQuickReply
 	UIModeCompose
+	UIModePrompt
+	UIModeMimeTree
+	UIModeFilter
 )
 
 type UIMode int
@@ -24,10 +27,19 @@ type UI struct {
 	//
 	foldersList        *tview.List
 	foldersListVisible bool
+	// every folder on the server, the names of the ones in the list, which
+	// are only the subscribed ones unless all are shown
+	folders            []FolderItem
+	foldersShown       []string
+	foldersShowAll     bool
+	foldersOutboxShown bool
 
-	emailsFrame                    *tview.Frame
-	emailsTable                    *tview.Table
+	emailsFrame *tview.Frame
+	emailsTable *tview.Table
+	// the rows shown, which are the emails of emailsUidListAll that match
+	// the filter
 	emailsUidList                  []uint32
+	emailsUidListAll               []uint32
 	emailUidSelectedBeforeDownload uint32
 	folderSelected                 string
 	folderItemCount                int
@@ -36,9 +48,32 @@ type UI struct {
 	// the first element selected until they manually change the selection
 	emailsPegSelectionToTop bool
 
+	// quick filter bar over the emails table, and the email selected before
+	// filtering to go back to when it's cleared
+	filterInput       *tview.InputField
+	filterText        string
+	filterUnread      bool
+	filterFlagged     bool
+	filterAttachments bool
+	filterUidBefore   uint32
+
+	// emails marked for bulk actions in the selected folder, the one last
+	// toggled that ranges start from, and the last bulk action to undo
+	markedUids    map[uint32]bool
+	markAnchorUid uint32
+	bulkUndo      *BulkUndo
+
 	previewText    *tview.TextArea
 	previewUid     uint32
 	previewVisible bool
+	// quick reply with the original quoted paragraph by paragraph, to
+	// comment in between, and the reply as it was first quoted
+	quickReplyInline bool
+	quickReplyQuoted string
+	// body, headers or source, and the raw message once downloaded for the
+	// latter two
+	previewView int
+	previewRaw  []byte
 
 	hintsBar        *tview.TextView
 	hintsBarVisible bool
@@ -47,10 +82,45 @@ type UI struct {
 	mainPane        *tview.Flex
 	emailsPane      *tview.Flex
 
+	// single line prompt shown over the main pane, e.g. snooze until
+	promptInput       *tview.InputField
+	promptFocusBefore tview.Primitive
+	promptModeBefore  UIMode
+
+	// mime tree pane, the parts of an email and the one picked
+	//
+	mimePane     *tview.Flex
+	mimeTree     *tview.TreeView
+	mimePartText *tview.TextView
+	mimeFolder   string
+	mimeUid      uint32
+
 	// compose pane
 	//
 	composePane *tview.Flex
 	composeForm *tview.Form
+	// attachments carried over from the email being forwarded, these are
+	// listed by filename in the attach field alongside any local paths
+	composeForwardedAttachments []Attachment
+	// identity picked in the from field, its signature is in the message
+	composeIdentity Identity
+	// outbox entry being edited, it's replaced when the edit is sent
+	composeOutboxId uint32
+	// set once a send was refused for bad addresses, the title then keeps
+	// showing what's wrong until the fields are fixed
+	composeShowAddressErrors bool
+	// encrypt was ticked or unticked by hand, pgp_encrypt = "auto" leaves
+	// it alone from then on
+	composeEncryptTouched bool
+	// send at of an email reopened from the outbox, as it was filled in
+	composeSendAtQueued string
+	// rendered markdown shown beside the form, toggled with ctrl+p
+	composeColumns        *tview.Flex
+	composePreview        *tview.TextView
+	composePreviewVisible bool
+
+	// last sent email, while it is still being held in the outbox
+	undoSendId uint32
 }
 
 type MailConfig struct {
@@ -60,6 +130,65 @@ type MailConfig struct {
 	Password    string `toml:"password"`
 	DisplayName string `toml:"display_name"`
 	Trace       bool   `toml:"trace,omitempty"`
+
+	// signature of the default identity, see Identity
+	Signature              string     `toml:"signature,omitempty"`
+	SignatureFile          string     `toml:"signature_file,omitempty"`
+	ReplySignaturePosition string     `toml:"reply_signature_position,omitempty"`
+	Identities             []Identity `toml:"identities,omitempty"`
+
+	// warn in compose once attachments add up to more than this
+	AttachmentWarnSizeMB int `toml:"attachment_warn_size_mb,omitempty"`
+	// external command to render html-only emails when they're shown, e.g.
+	// "w3m -dump -T text/html", html is piped to stdin. The builtin renderer
+	// is used until then, and always when empty
+	HTMLFilter string `toml:"html_filter,omitempty"`
+	// where the outbox and other local state is kept
+	DataDir string `toml:"data_dir,omitempty"`
+	// snoozed emails are moved here until they wake up
+	SnoozeFolder string `toml:"snooze_folder,omitempty"`
+	// copies of sent emails are saved here
+	SentFolder string `toml:"sent_folder,omitempty"`
+	// where emails are moved to by archive, delete and junk
+	ArchiveFolder string `toml:"archive_folder,omitempty"`
+	TrashFolder   string `toml:"trash_folder,omitempty"`
+	JunkFolder    string `toml:"junk_folder,omitempty"`
+	// compose starts in markdown mode, sending an html part alongside the
+	// plain text
+	Markdown bool `toml:"markdown,omitempty"`
+
+	// armored or binary keyrings, public keys of who we write to and our own
+	// secret keys, unlocked with the passphrase
+	PGPPublicKeyring string `toml:"pgp_public_keyring,omitempty"`
+	PGPSecretKeyring string `toml:"pgp_secret_keyring,omitempty"`
+	PGPPassphrase    string `toml:"pgp_passphrase,omitempty"`
+	// compose starts with sign ticked
+	PGPSign bool `toml:"pgp_sign,omitempty"`
+	// "never", "always", or "auto" to encrypt when all recipients have keys
+	PGPEncrypt string `toml:"pgp_encrypt,omitempty"`
+
+	// pem files, s/mime signatures are trusted when they chain up to the ca
+	// bundle, or the system roots when it's empty. Our certificate, followed
+	// by its chain, and key are for signing what we send
+	SMIMECABundle    string `toml:"smime_ca_bundle,omitempty"`
+	SMIMECertificate string `toml:"smime_certificate,omitempty"`
+	SMIMEKey         string `toml:"smime_key,omitempty"`
+	// compose starts with s/mime sign ticked
+	SMIMESign bool `toml:"smime_sign,omitempty"`
+	// bodies of this many emails either side of the selected one, and of
+	// this many of the most recent unread emails, are downloaded in the
+	// background, up to prefetch_budget_mb each time the selection changes
+	PrefetchNearby   int `toml:"prefetch_nearby"`
+	PrefetchUnread   int `toml:"prefetch_unread"`
+	PrefetchBudgetMB int `toml:"prefetch_budget_mb"`
+	// most memory used for downloaded bodies, less recently viewed ones are
+	// moved to disk past it, defaults to bodyCacheMBDefault
+	BodyCacheMB int `toml:"body_cache_mb,omitempty"`
+	// sent emails wait in the outbox this long so the send can be undone,
+	// defaults to sendDelaySecondsDefault when not in the config
+	SendDelaySeconds int `toml:"send_delay_seconds"`
+	// vcard files imported into the address book on start
+	VCardFiles []string `toml:"vcard_files,omitempty"`
 }
 
 var (
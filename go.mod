@@ -1,4 +1,5 @@
-module main
+// not main, go test can't build the tests of a module with that path
+module kagimail
 
 go 1.23.0
 
@@ -6,6 +7,7 @@ toolchain go1.23.8
 
 require (
 	github.com/BurntSushi/toml v1.5.0
+	github.com/ProtonMail/go-crypto v1.5.2
 	github.com/cloudfoundry/jibber_jabber v0.0.0-20151120183258-bcc4c8345a21
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-imap-sortthread v1.2.0
@@ -13,10 +15,15 @@ require (
 	github.com/gdamore/tcell/v2 v2.8.1
 	github.com/goodsign/monday v1.0.2
 	github.com/rivo/tview v0.0.0-20250330220935-949945f8d922
+	github.com/yuin/goldmark v1.4.13
+	go.mozilla.org/pkcs7 v0.10.0
+	golang.org/x/net v0.42.0
+	golang.org/x/text v0.28.0
 	gopkg.in/mail.v2 v2.3.1
 )
 
 require (
+	github.com/cloudflare/circl v1.6.3 // indirect
 	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
 	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 	github.com/gdamore/encoding v1.0.1 // indirect
@@ -25,8 +32,8 @@ require (
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.37.0 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.31.0 // indirect
-	golang.org/x/term v0.28.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/term v0.34.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/textproto"
+)
+
+// what the preview pane shows for the selected email, cycled with v
+const (
+	previewViewBody = iota
+	previewViewHeaders
+	previewViewSource
+	previewViewCount
+)
+
+// downloads the whole message as it is on the server, peeking so viewing
+// the source doesn't mark it read
+func fetchEmailSource(folder string, uid uint32) ([]byte, error) {
+	var raw []byte
+	err := imapCommand(folder, func(clt *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		section := &imap.BodySectionName{Peek: true}
+		chEmails := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- clt.UidFetch(seqSet,
+				[]imap.FetchItem{section.FetchItem()}, chEmails)
+		}()
+		for imapEmail := range chEmails {
+			if reader := imapEmail.GetBody(section); reader != nil {
+				var buf bytes.Buffer
+				_, err := buf.ReadFrom(reader)
+				if err != nil {
+					return err
+				}
+				raw = buf.Bytes()
+			}
+		}
+		return <-done
+	})
+	if err == nil && raw == nil {
+		err = fmt.Errorf("email %d is no longer in %s", uid, folder)
+	}
+	return raw, err
+}
+
+// strips (comments) from a header value, they can nest
+func headerStripComments(value string) string {
+	var stripped strings.Builder
+	depth := 0
+	for _, r := range value {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			stripped.WriteRune(r)
+		}
+	}
+	return stripped.String()
+}
+
+// one line per spf, dkim, dmarc and arc result from each
+// Authentication-Results header, e.g.
+// "DKIM    pass      header.d=example.com, checked by mx.example.com"
+func headersAuthSummary(header textproto.Header) []string {
+	var lines []string
+	for _, value := range header.Values("Authentication-Results") {
+		results := strings.Split(headerStripComments(value), ";")
+		checkedBy := strings.TrimSpace(results[0])
+		for _, result := range results[1:] {
+			fields := strings.Fields(result)
+			if len(fields) == 0 {
+				continue
+			}
+			method, verdict, ok := strings.Cut(fields[0], "=")
+			if !ok {
+				continue
+			}
+			switch strings.ToLower(method) {
+			case "spf", "dkim", "dmarc", "arc":
+			default:
+				continue
+			}
+			line := fmt.Sprintf("%-7s %-9s %s", strings.ToUpper(method),
+				verdict, strings.Join(fields[1:], " "))
+			lines = append(lines, strings.TrimRight(line, " ")+
+				", checked by "+checkedBy)
+		}
+	}
+
+	// older servers only add this one
+	if len(lines) == 0 {
+		for _, value := range header.Values("Received-SPF") {
+			verdict, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+			lines = append(lines, fmt.Sprintf("%-7s %s", "SPF", verdict))
+		}
+	}
+	if len(lines) == 0 {
+		for _, value := range header.Values("DKIM-Signature") {
+			params := headerParams(value)
+			lines = append(lines, fmt.Sprintf("%-7s %-9s d=%s",
+				"DKIM", "unchecked", params["d"]))
+		}
+	}
+	return lines
+}
+
+// the tag=value; list of a DKIM-Signature
+func headerParams(value string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(value, ";") {
+		key, value, ok := strings.Cut(param, "=")
+		if ok {
+			params[strings.TrimSpace(key)] = strings.Join(
+				strings.Fields(value), "")
+		}
+	}
+	return params
+}
+
+// each hop with the time it was received, from where the email was sent
+// down to us, comments are kept since they usually hold the ip
+func headersReceivedChain(header textproto.Header) []string {
+	received := header.Values("Received")
+	var lines []string
+	for i := len(received) - 1; i >= 0; i-- {
+		hop, date, _ := strings.Cut(received[i], ";")
+		hop = strings.Join(strings.Fields(hop), " ")
+		date = strings.Join(strings.Fields(date), " ")
+		lines = append(lines, fmt.Sprintf("%d. %s", len(received)-i, hop))
+		if date != "" {
+			lines = append(lines, "   "+date)
+		}
+	}
+	return lines
+}
+
+// the summary of how the email got to us followed by the header block as it
+// was received
+func headersText(raw []byte) string {
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		headerEnd = bytes.Index(raw, []byte("\n\n"))
+	}
+	if headerEnd == -1 {
+		headerEnd = len(raw)
+	}
+	block := strings.ReplaceAll(string(raw[:headerEnd]), "\r\n", "\n")
+
+	header, err := textproto.ReadHeader(
+		bufio.NewReader(bytes.NewReader(raw[:headerEnd])))
+	if err != nil {
+		return fmt.Sprintf("<unable to parse headers: %v>\n\n%s", err, block)
+	}
+
+	var text strings.Builder
+	if auth := headersAuthSummary(header); len(auth) > 0 {
+		text.WriteString("Authentication:\n")
+		for _, line := range auth {
+			text.WriteString("  " + line + "\n")
+		}
+		text.WriteString("\n")
+	}
+	if chain := headersReceivedChain(header); len(chain) > 0 {
+		text.WriteString("Received, oldest first:\n")
+		for _, line := range chain {
+			text.WriteString("  " + line + "\n")
+		}
+		text.WriteString("\n")
+	}
+	text.WriteString(block)
+	return text.String()
+}
+
+// shows the body, headers or source of the selected email in the preview,
+// the raw message is downloaded the first time it is needed
+func previewPaneSetView(view int) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.previewView = view
+	uid := g_ui.previewUid
+	folder := g_ui.folderSelected
+	email := cachedEmailFromUid(folder, uid)
+
+	switch view {
+	case previewViewBody:
+		title := "Preview"
+		if email.security != "" {
+			title += ", " + email.security
+		}
+		g_ui.previewText.SetTitle(title)
+		g_ui.previewText.SetText(email.body, false)
+		return
+	case previewViewHeaders:
+		g_ui.previewText.SetTitle("Preview, Headers")
+	case previewViewSource:
+		g_ui.previewText.SetTitle("Preview, Source")
+	}
+
+	if g_ui.previewRaw == nil {
+		g_ui.previewText.SetText("", false)
+		updateStatusBar(fmt.Sprintf(
+			"Downloading source of email id: %d from %s", uid, folder))
+		go func() {
+			raw, err := fetchEmailSource(folder, uid)
+			g_ui.app.QueueUpdateDraw(func() {
+				if err != nil {
+					updateStatusBar(fmt.Sprintf(
+						"Unable to download source of email id %d: %v",
+						uid, err))
+					return
+				}
+				updateStatusBar(fmt.Sprintf(
+					"Downloaded source of email id: %d, size of %s", uid,
+					FormatHumanReadableSize(int64(len(raw)))))
+				if g_ui.previewUid != uid || g_ui.folderSelected != folder {
+					return
+				}
+				g_ui.previewRaw = raw
+				if g_ui.previewView != previewViewBody {
+					previewPaneSetView(g_ui.previewView)
+				}
+			})
+		}()
+		return
+	}
+
+	if view == previewViewHeaders {
+		g_ui.previewText.SetText(headersText(g_ui.previewRaw), false)
+	} else {
+		g_ui.previewText.SetText(
+			strings.ReplaceAll(string(g_ui.previewRaw), "\r\n", "\n"), false)
+	}
+}
+
+func previewPaneCycleView() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.previewUid == 0 || g_ui.folderSelected == outboxFolder {
+		updateStatusBar("No message selected to view the source of")
+		return
+	}
+	if g_ui.previewVisible == false {
+		togglePreviewBar()
+	}
+	previewPaneSetView((g_ui.previewView + 1) % previewViewCount)
+}
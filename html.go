@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// renders html mail into readable text, used when an email has no text/plain
+// part. Links become numbered footnotes listed at the end. It's also what
+// html_filter falls back to, the filter is only run by htmlFilterKeep and
+// htmlFilterShown for emails that are shown, not for prefetched ones or the
+// compose preview.
+func htmlToText(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return src
+	}
+
+	r := htmlTextRenderer{lineStart: true}
+	r.renderChildren(doc)
+
+	text := strings.TrimSpace(r.out.String())
+	if len(r.links) > 0 {
+		var footnotes strings.Builder
+		footnotes.WriteString("\n\n")
+		for i, link := range r.links {
+			footnotes.WriteString(fmt.Sprintf("[%d]: %s\n", i+1, link))
+		}
+		text += strings.TrimRight(footnotes.String(), "\n")
+	}
+	return text
+}
+
+// keeps the html of a body that was just rendered by the builtin renderer,
+// for html_filter once the email is shown
+func htmlFilterKeep(folder string, uid uint32, src string) {
+	if g_config.HTMLFilter == "" || src == "" {
+		return
+	}
+	cachedEmailBodyHTMLSet(folder, uid, src)
+}
+
+// renders the body of an email being shown with html_filter, once
+func htmlFilterShown(folder string, uid uint32) {
+	email := cachedEmailFromUid(folder, uid)
+	if g_config.HTMLFilter == "" || email.bodyHTML == "" {
+		return
+	}
+	text, err := htmlToTextViaFilter(g_config.HTMLFilter, email.bodyHTML)
+	if err != nil {
+		log.Printf("html filter \"%s\" failed, using builtin: %v",
+			g_config.HTMLFilter, err)
+	}
+	cachedEmailBodyFiltered(folder, uid, text)
+}
+
+// e.g. html_filter = "w3m -dump -T text/html", html is passed on stdin
+func htmlToTextViaFilter(filter string, src string) (string, error) {
+	cmd := exec.Command("sh", "-c", filter)
+	cmd.Stdin = strings.NewReader(src)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+type htmlTextRenderer struct {
+	out   strings.Builder
+	links []string
+
+	// written at the start of every line, e.g. "> " for blockquotes
+	prefixes        []string
+	lineStart       bool
+	pendingSpace    bool
+	pendingNewlines int
+	// newlines already written at the end of out, so nested blocks don't
+	// stack up blank lines
+	trailingNewlines int
+	preDepth         int
+}
+
+func (r *htmlTextRenderer) blockBreak(newlines int) {
+	if r.out.Len() == 0 {
+		return
+	}
+	r.pendingSpace = false
+	r.pendingNewlines = max(r.pendingNewlines, newlines-r.trailingNewlines)
+}
+
+func (r *htmlTextRenderer) flushNewlines() {
+	for ; r.pendingNewlines > 0; r.pendingNewlines-- {
+		if r.lineStart {
+			r.out.WriteString(strings.TrimRight(strings.Join(r.prefixes, ""), " "))
+		}
+		r.out.WriteByte('\n')
+		r.lineStart = true
+		r.trailingNewlines++
+	}
+}
+
+func (r *htmlTextRenderer) write(s string) {
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line == "" {
+			continue
+		}
+		r.flushNewlines()
+		if r.lineStart {
+			r.out.WriteString(strings.Join(r.prefixes, ""))
+			r.lineStart = false
+		} else if r.pendingSpace {
+			r.out.WriteByte(' ')
+		}
+		r.pendingSpace = false
+		r.out.WriteString(strings.TrimSuffix(line, "\n"))
+		r.trailingNewlines = 0
+		if strings.HasSuffix(line, "\n") {
+			r.out.WriteByte('\n')
+			r.lineStart = true
+			r.trailingNewlines = 1
+		}
+	}
+}
+
+func (r *htmlTextRenderer) text(s string) {
+	if r.preDepth > 0 {
+		r.write(s)
+		return
+	}
+
+	words := strings.FieldsFunc(s, unicode.IsSpace)
+	if len(words) == 0 {
+		if s != "" {
+			r.pendingSpace = !r.lineStart
+		}
+		return
+	}
+	if unicode.IsSpace(rune(s[0])) && !r.lineStart {
+		r.pendingSpace = true
+	}
+	r.write(strings.Join(words, " "))
+	if unicode.IsSpace(rune(s[len(s)-1])) {
+		r.pendingSpace = true
+	}
+}
+
+func (r *htmlTextRenderer) withPrefix(prefix string, fn func()) {
+	r.flushNewlines()
+	r.prefixes = append(r.prefixes, prefix)
+	fn()
+	r.prefixes = r.prefixes[:len(r.prefixes)-1]
+}
+
+func (r *htmlTextRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *htmlTextRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		r.renderChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Template:
+		return
+
+	case atom.Br:
+		if r.out.Len() > 0 {
+			r.pendingSpace = false
+			r.pendingNewlines = min(r.pendingNewlines+1, 2)
+		}
+
+	case atom.Hr:
+		r.blockBreak(2)
+		r.write(strings.Repeat("-", 40))
+		r.blockBreak(2)
+
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header,
+		atom.Footer, atom.Center, atom.Address:
+		newlines := 1
+		if n.DataAtom == atom.P {
+			newlines = 2
+		}
+		r.blockBreak(newlines)
+		r.renderChildren(n)
+		r.blockBreak(newlines)
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.blockBreak(2)
+		r.write(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		r.renderChildren(n)
+		r.blockBreak(2)
+
+	case atom.Pre:
+		r.blockBreak(2)
+		r.preDepth++
+		r.renderChildren(n)
+		r.preDepth--
+		r.blockBreak(2)
+
+	case atom.Blockquote:
+		r.blockBreak(2)
+		r.withPrefix("> ", func() { r.renderChildren(n) })
+		r.blockBreak(2)
+
+	case atom.Ul, atom.Ol:
+		r.blockBreak(1)
+		k := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+				r.render(c)
+				continue
+			}
+			k++
+			bullet := "* "
+			if n.DataAtom == atom.Ol {
+				bullet = fmt.Sprintf("%d. ", k)
+			}
+			r.blockBreak(1)
+			r.write(bullet)
+			r.withPrefix(strings.Repeat(" ", len(bullet)), func() {
+				r.renderChildren(c)
+			})
+			r.blockBreak(1)
+		}
+		r.blockBreak(1)
+
+	case atom.Table:
+		r.blockBreak(2)
+		r.renderTable(n)
+		r.blockBreak(2)
+
+	case atom.A:
+		href := htmlAttr(n, "href")
+		r.renderChildren(n)
+		if href == "" || strings.HasPrefix(href, "#") {
+			return
+		}
+		// skip footnotes for links that are just their own text
+		if strings.TrimSpace(htmlNodeText(n)) == href {
+			return
+		}
+		r.links = append(r.links, href)
+		r.write(fmt.Sprintf("[%d]", len(r.links)))
+
+	case atom.Img:
+		alt := strings.TrimSpace(htmlAttr(n, "alt"))
+		if alt != "" {
+			r.text(fmt.Sprintf("[%s]", alt))
+		}
+
+	case atom.B, atom.Strong:
+		r.write("*")
+		r.renderChildren(n)
+		r.write("*")
+
+	case atom.I, atom.Em:
+		r.write("_")
+		r.renderChildren(n)
+		r.write("_")
+
+	default:
+		r.renderChildren(n)
+	}
+}
+
+// renders each row on its own line with cells separated by " | ", layout
+// tables in newsletters nest these, which flatten into the same lines
+func (r *htmlTextRenderer) renderTable(table *html.Node) {
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Tr:
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+						cells = append(cells, cell)
+					}
+				}
+				r.blockBreak(1)
+				for i, cell := range cells {
+					if i > 0 && strings.TrimSpace(htmlNodeText(cell)) != "" {
+						r.write(" | ")
+					}
+					r.renderChildren(cell)
+				}
+				r.blockBreak(1)
+			case atom.Table:
+				r.renderTable(c)
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(table)
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func htmlNodeText(n *html.Node) string {
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return text.String()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHtmlToText(t *testing.T) {
+	g_config = MailConfig{}
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"links as footnotes",
+			`<p>See <a href="https://example.com/a">the docs</a> and ` +
+				`<a href="https://example.com/b">this</a>.</p>` +
+				`<p><a href="https://example.com">https://example.com</a> ` +
+				`<a href="#top">top</a></p>`,
+			"See the docs[1] and this[2].\n\n" +
+				"https://example.com top\n\n" +
+				"[1]: https://example.com/a\n" +
+				"[2]: https://example.com/b"},
+		{"lists",
+			`<ul><li>one</li><li>two<ul><li>nested</li></ul></li></ul>` +
+				`<ol><li>first</li><li>second</li></ol>`,
+			"* one\n* two\n  * nested\n1. first\n2. second"},
+		{"tables",
+			`<table><tr><th>Name</th><th>Qty</th></tr>` +
+				`<tr><td>apple</td><td>3</td></tr>` +
+				`<tr><td>pear</td><td></td></tr></table>`,
+			"Name | Qty\napple | 3\npear"},
+		{"blockquotes",
+			`<p>On Monday Bob wrote:</p><blockquote><p>first</p>` +
+				`<blockquote>inner</blockquote></blockquote><p>reply</p>`,
+			"On Monday Bob wrote:\n\n> first\n>\n> > inner\n\nreply"},
+		{"headings, emphasis and breaks",
+			`<html><head><title>x</title><style>p{}</style></head><body>` +
+				`<h2>Title</h2><p>a <b>bold</b> and <i>it</i><br>next line</p>` +
+				`<hr><img alt="logo"><script>alert(1)</script></body></html>`,
+			"## Title\n\na *bold* and _it_\nnext line\n\n" +
+				"----------------------------------------\n\n[logo]"},
+		{"pre keeps its spacing",
+			"<p>code:</p><pre>  one\n    two</pre>",
+			"code:\n\n  one\n    two"},
+		{"whitespace collapses",
+			"<div>  lots   of\n  space  </div><div>x</div>",
+			"lots of space\nx"},
+	}
+	for _, test := range tests {
+		if got := htmlToText(test.html); got != test.want {
+			t.Errorf("%s: htmlToText = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHtmlFilterOnlyWhenShown(t *testing.T) {
+	testModelInit(t)
+	g_config.HTMLFilter = "tr a-z A-Z"
+	if got := htmlToText("<p>hello</p>"); got != "hello" {
+		t.Errorf("htmlToText = %q, html_filter ran for a body not shown", got)
+	}
+
+	cachedEmailEnvelopeSet(&Email{uid: 1, seqNum: 1, folder: "Inbox"})
+	cachedEmailBodyUpdate("Inbox", 1, "hello", nil, 0, 0, true, "")
+	htmlFilterKeep("Inbox", 1, "<p>hello</p>")
+	htmlFilterShown("Inbox", 1)
+	email := cachedEmailFromUid("Inbox", 1)
+	if email.body != "<P>HELLO</P>" || email.bodyHTML != "" {
+		t.Errorf("shown body %q, html %q, want the html_filter output",
+			email.body, email.bodyHTML)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/mail.v2"
+)
+
+const (
+	signatureDelimiter = "-- "
+
+	signaturePositionAbove = "above"
+	signaturePositionBelow = "below"
+)
+
+// an address we send as, the top level of kagimail.toml is the default
+// identity, and more can be added as [[identities]]
+type Identity struct {
+	Email         string `toml:"email"`
+	DisplayName   string `toml:"display_name"`
+	Signature     string `toml:"signature,omitempty"`
+	SignatureFile string `toml:"signature_file,omitempty"`
+	// where the signature goes when replying, "above" or "below" the quote
+	ReplySignaturePosition string `toml:"reply_signature_position,omitempty"`
+}
+
+func identities() []Identity {
+	identities := []Identity{{
+		Email:                  g_config.Email,
+		DisplayName:            g_config.DisplayName,
+		Signature:              g_config.Signature,
+		SignatureFile:          g_config.SignatureFile,
+		ReplySignaturePosition: g_config.ReplySignaturePosition,
+	}}
+	return append(identities, g_config.Identities...)
+}
+
+func identityDefault() Identity {
+	return identities()[0]
+}
+
+// replies go out from whichever of our addresses the email was sent to
+func identityForReply(email Email) Identity {
+	recipients, _ := parseAddressList(email.toAddress + "," + email.ccAddress)
+	for _, identity := range identities() {
+		for _, recipient := range recipients {
+			if strings.EqualFold(recipient.Address, identity.Email) {
+				return identity
+			}
+		}
+	}
+	return identityDefault()
+}
+
+func identityIsOurs(address string) bool {
+	for _, identity := range identities() {
+		if strings.EqualFold(identity.Email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func identityFromAddress(address string) Identity {
+	for _, identity := range identities() {
+		if strings.EqualFold(identity.Email, address) {
+			return identity
+		}
+	}
+	return identityDefault()
+}
+
+func (identity Identity) String() string {
+	return mail.NewMessage().FormatAddress(identity.Email, identity.DisplayName)
+}
+
+func (identity Identity) signature() string {
+	signature := identity.Signature
+	if identity.SignatureFile != "" {
+		data, err := os.ReadFile(expandHomeDir(identity.SignatureFile))
+		if err != nil {
+			log.Printf("unable to read signature file \"%s\": %v",
+				identity.SignatureFile, err)
+		} else {
+			signature = string(data)
+		}
+	}
+	return strings.Trim(signature, "\n")
+}
+
+// the signature with its "-- " delimiter line, empty if there is none
+func (identity Identity) signatureBlock() string {
+	signature := identity.signature()
+	if signature == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s\n%s\n", signatureDelimiter, signature)
+}
+
+func (identity Identity) replySignatureAbove() bool {
+	return !strings.EqualFold(
+		identity.ReplySignaturePosition, signaturePositionBelow)
+}
+
+// cuts the signature off of text, at the first line that is just the "-- "
+// delimiter
+func stripSignature(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r") == signatureDelimiter {
+			return strings.TrimRight(strings.Join(lines[:i], "\n"), "\n")
+		}
+	}
+	return text
+}
+
+// swaps the signature block of one identity for another's in a body being
+// composed, or adds it if the body doesn't have one yet
+func replaceSignatureBlock(body string, from Identity, to Identity) string {
+	blockFrom := from.signatureBlock()
+	blockTo := to.signatureBlock()
+	if blockFrom != "" && strings.Contains(body, blockFrom) {
+		return strings.Replace(body, blockFrom, blockTo, 1)
+	}
+	if blockTo == "" {
+		return body
+	}
+	return strings.TrimRight(body, "\n") + "\n\n" + blockTo
+}
@@ -7,13 +7,13 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"sort"
+	"slices"
 	"strings"
 
-	"github.com/BurntSushi/toml"
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 )
 
@@ -40,23 +40,50 @@ type FetchFolderListRequest struct {
 	done chan error
 }
 
+// runs on its own connection for commands that change things on the server,
+// folder is selected read-write first unless it is empty
+type ImapCommandRequest struct {
+	folder string
+	run    func(clt *client.Client) error
+	done   chan error
+}
+
+// the only folder we idle on, changes to it reach us through the idle
+// updates, so we don't need to update our cache for it ourselves
+const imapIdleFolder = "Inbox"
+
 var (
 	chFetchFolder     chan FetchFolderRequest
 	chFetchEmailBody  chan FetchEmailBodyRequest
 	chFetchFolderList chan FetchFolderListRequest
+	chImapCommand     chan ImapCommandRequest
 )
 
 func fetchEmailBody(folder string, uid uint32) {
 	assertValidFolderName(folder)
 	var err error = nil
 	var flags uint = 0
-	if cachedEmailFromUid(folder, uid).body == "" {
+	email := cachedEmailFromUid(folder, uid)
+	if email.body != "" {
+		g_bodyCacheHits.Add(1)
+		cachedEmailBodyTouch(folder, uid)
+		flags |= notifyFetchEmailPulledFromCache
+	} else if bodyCacheRestore(folder, uid) {
+		g_bodyCacheDiskHits.Add(1)
+		flags |= notifyFetchEmailPulledFromDisk
+	} else {
+		g_bodyCacheMisses.Add(1)
 		notifyFetchEmailBodyStarted(folder, uid)
 		done := make(chan error, 1)
 		chFetchEmailBody <- FetchEmailBodyRequest{folder, uid, done}
 		err = <-done
-	} else {
-		flags |= notifyFetchEmailPulledFromCache
+	}
+	// prefetched bodies were downloaded without marking them read
+	if flags != 0 && !email.isRead {
+		go emailMarkRead(folder, uid)
+	}
+	if err == nil {
+		htmlFilterShown(folder, uid)
 	}
 	notifyFetchEmailBodyFinished(err, folder, uid, flags)
 }
@@ -94,10 +121,19 @@ func fetchFolderList() {
 	}
 }
 
+func imapCommand(folder string, run func(clt *client.Client) error) error {
+	done := make(chan error, 1)
+	chImapCommand <- ImapCommandRequest{folder, run, done}
+	return <-done
+}
+
 func imapInit() {
 	chFetchFolder = make(chan FetchFolderRequest, 10)
 	chFetchEmailBody = make(chan FetchEmailBodyRequest, 10)
 	chFetchFolderList = make(chan FetchFolderListRequest, 1)
+	chImapCommand = make(chan ImapCommandRequest, 10)
+	chPrefetch = make(chan PrefetchRequest, 10)
+	charsetInit()
 
 	go imapWorker()
 
@@ -108,6 +144,8 @@ func imapInit() {
 	go func() {
 		fetchFolder("Inbox", fetchFolderOptionAllEmails)
 	}()
+
+	go snoozeWorker()
 }
 
 func imapLogin() *client.Client {
@@ -155,6 +193,9 @@ func imapFetchViaCriteria(
 					return emails
 				}
 
+				// whether fetched for a folder or after idle, every
+				// envelope we see goes into the address book
+				contactsHarvestEnvelope(imapEmail.Envelope)
 				email := emailFromImapEmail(folder, imapEmail)
 				emails = append(emails, email)
 
@@ -180,15 +221,27 @@ func imapFetchViaCriteria(
 		return
 	}
 	sortClt := sortthread.NewSortClient(clt)
-
-	sortCriteria := []sortthread.SortCriterion{
-		{Field: sortthread.SortDate, Reverse: true},
+	sortCriteria := imapSortCriteria(
+		cachedEmailSortFromFolder(getNormalizedImapFolderName(folder)))
+	supportsSort, err := sortClt.SupportSort()
+	if err != nil {
+		chAllDone <- err
+		return
 	}
 
 	// get a list of uids in sorted order
 	//
 	var uids []uint32
-	if searchCriteria.SeqNum != nil {
+	if searchCriteria.SeqNum != nil && supportsSort {
+		// one SORT over the whole range in the folder's order, so the
+		// emails at the top of the table are downloaded first, the table
+		// still sorts them as they come in
+		uids, err = sortClt.UidSort(sortCriteria, searchCriteria)
+		if err != nil {
+			chAllDone <- err
+			return
+		}
+	} else if searchCriteria.SeqNum != nil {
 		Assert(len(searchCriteria.SeqNum.Set) == 1, "only works with 1 seq")
 		loWater := int(searchCriteria.SeqNum.Set[0].Start)
 		hiWater := int(searchCriteria.SeqNum.Set[0].Stop) + 1
@@ -203,11 +256,13 @@ func imapFetchViaCriteria(
 				searchCriteria.SeqNum.AddRange(uint32(lo), uint32(hi))
 			}
 
-			uids_, err := sortClt.UidSort(sortCriteria, searchCriteria)
+			// newest first, the table sorts them as they come in
+			uids_, err := clt.UidSearch(searchCriteria)
 			if err != nil {
 				chAllDone <- err
 				return
 			}
+			slices.Reverse(uids_)
 
 			if hasCancelled() {
 				return
@@ -260,17 +315,17 @@ func imapFetchViaCriteria(
 				if flags&fetchEmailBodyViaUID != 0 {
 					Assert(!clt.Mailbox().ReadOnly,
 						"we need folder write access for flipping seen flag")
-					section := &imap.BodySectionName{
-						Peek: false,
-					}
-					fi = append(fi, section.FetchItem())
+					fi = append(fi,
+						imap.FetchBodyStructure, imap.FetchRFC822Size)
 				} else {
-					fi = append(fi, imap.FetchEnvelope)
+					fi = append(fi, imap.FetchEnvelope,
+						imap.FetchInternalDate, imap.FetchRFC822Size)
 				}
 				chFetchDone <- clt.UidFetch(seqSet, fi, chEmails)
 			}()
 
 			if flags&fetchEmailBodyViaUID != 0 {
+				var imapEmails []*imap.Message
 			fetchLoop:
 				for {
 					select {
@@ -282,8 +337,8 @@ func imapFetchViaCriteria(
 							break fetchLoop
 						}
 
-						trace("downloaded body for: %d", imapEmail.Uid)
-						updateEmailBody(folder, imapEmail)
+						trace("downloaded structure for: %d", imapEmail.Uid)
+						imapEmails = append(imapEmails, imapEmail)
 					}
 				}
 				err = <-chFetchDone
@@ -291,11 +346,18 @@ func imapFetchViaCriteria(
 					chAllDone <- err
 					return
 				}
+
+				// the structure tells us which part to download
+				for _, imapEmail := range imapEmails {
+					err = updateEmailBody(clt, folder, imapEmail, false)
+					if err != nil {
+						chAllDone <- err
+						return
+					}
+				}
 			} else {
 				emails := collectEmails(ctx, folder, chEmails)
-				sort.Slice(emails, func(i, j int) bool {
-					return emailCompare(emails[i], emails[j])
-				})
+				cachedEmailsSort(folder, emails)
 				for _, email := range emails {
 					if hasCancelled() {
 						return
@@ -323,11 +385,6 @@ func imapFetchViaCriteria(
 }
 
 func imapWorker() {
-	_, err := toml.DecodeFile("kagimail.toml", &g_config)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	//  high-priority view messages
 	go func() {
 		cltDownloadBody := imapLogin()
@@ -369,25 +426,11 @@ func imapWorker() {
 		for {
 			select {
 			case req := <-chFetchFolderList:
-				mailboxes := make(chan *imap.MailboxInfo, 10)
-				done := make(chan error, 1)
-
-				go func() {
-					done <- cltFillLists.List(
-						"" /* base folder hierarchy */, "*", mailboxes)
-				}()
-
-				err := <-done
-				if err != nil {
-					req.done <- err
-					return
+				folders, err := imapListFolders(cltFillLists)
+				if err == nil {
+					notifyFolderListFetched(folders)
 				}
-
-				for mailbox := range mailboxes {
-					insertFolderToList(mailbox.Name)
-				}
-
-				req.done <- nil
+				req.done <- err
 
 			case req := <-chFetchFolder:
 				mailbox, err := cltFillLists.Select(
@@ -420,16 +463,35 @@ func imapWorker() {
 		}
 	}()
 
+	// low-priority downloading of bodies the user is likely to view next
+	go prefetchWorker()
+
+	// moving, flagging and other changes to emails and folders
+	go func() {
+		cltCommands := imapLogin()
+		defer cltCommands.Logout()
+		for req := range chImapCommand {
+			if req.folder != "" {
+				_, err := cltCommands.Select(req.folder, false /* readOnly */)
+				if err != nil {
+					req.done <- err
+					continue
+				}
+			}
+			req.done <- req.run(cltCommands)
+		}
+	}()
+
 	// imap idle handlers
 	//
 	chImapUpdates := make(chan client.Update, 10)
 
 	// separate client to listen for idle commands to fetch new incoming emails
-	folderUpdates := "Inbox"
+	folderUpdates := imapIdleFolder
 	go func() {
 		cltIdle := imapLogin()
 		defer cltIdle.Logout()
-		_, err = cltIdle.Select(folderUpdates, true /* readOnly */)
+		_, err := cltIdle.Select(folderUpdates, true /* readOnly */)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -514,46 +576,131 @@ func imapWorker() {
 	}()
 }
 
-func updateEmailBody(folder string, imapEmail *imap.Message) error {
+// downloads only the part of the email that's shown, attachments are listed
+// from the body structure and downloaded when they are needed. Signed and
+// encrypted emails are downloaded whole, verifying and decrypting needs it.
+// Peeking leaves the email unread, for prefetching
+func updateEmailBody(
+	clt *client.Client, folder string, imapEmail *imap.Message, peek bool,
+) error {
 	Require(imapEmail.Uid != 0, "requires uid")
-	section := &imap.BodySectionName{
-		Peek: false,
+	structure := imapEmail.BodyStructure
+	if structure == nil {
+		return errors.New("email message has no body structure")
 	}
-	reader := imapEmail.GetBody(section)
-	if reader == nil {
-		return errors.New("email message has no body")
-	}
-	var buf bytes.Buffer
-	n, err := io.Copy(&buf, reader)
-	if err != nil {
-		return errors.New(fmt.Sprintf("unable to copy email buffer: %v", err))
+
+	if bodyStructureIsSecured(structure) {
+		section := &imap.BodySectionName{Peek: peek}
+		raw, isRead, err := imapFetchSection(clt, imapEmail.Uid, section)
+		if err != nil {
+			return err
+		}
+		return updateEmailBodyFromRaw(folder, imapEmail, raw, isRead)
 	}
 
-	mailReader, err := mail.CreateReader(bytes.NewReader(buf.Bytes()))
+	// the header is all we need of emails without text, fetching it without
+	// peeking still marks them read like the text would
+	textPart, attachments := bodyStructureTextPart(structure)
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek:         peek,
+	}
+	if textPart != nil {
+		section = &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Path: textPart.path},
+			Peek:         peek,
+		}
+	}
+	data, isRead, err := imapFetchSection(clt, imapEmail.Uid, section)
 	if err != nil {
-		return errors.New(fmt.Sprintf("unable to create reader: %v", err))
+		return err
 	}
 
 	plainText := ""
-	for {
-		part, err := mailReader.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return errors.New(fmt.Sprintf(
-				"unable to read all parts of emails: %v", err))
+	htmlText := ""
+	if textPart != nil {
+		decoded, err := mimeDecodeTransfer(textPart.structure.Encoding, data)
+		if err != nil {
+			return fmt.Errorf("unable to decode part %s: %v",
+				textPart.name(), err)
+		}
+		params := textPart.structure.Params
+		plainText = mimeDecodeCharset(params["charset"], decoded)
+		if strings.EqualFold(textPart.structure.MIMESubType, "html") {
+			htmlText = plainText
+			plainText = htmlToText(htmlText)
+		} else if strings.EqualFold(params["format"], "flowed") {
+			plainText = flowedDecode(plainText,
+				strings.EqualFold(params["delsp"], "yes"))
 		}
+	}
 
-		switch header := part.Header.(type) {
-		case *mail.InlineHeader:
-			contentType, _, _ := header.ContentType()
+	if plainText == "" {
+		plainText = fmt.Sprintf(
+			"<no plaintext message found, email size: %s>",
+			FormatHumanReadableSize(int64(imapEmail.Size)),
+		)
+	}
 
-			if strings.Contains(contentType, "text/plain") {
-				data, _ := io.ReadAll(part.Body)
-				plainText = string(data)
-				break
+	cachedEmailBodyUpdate(folder, imapEmail.Uid, plainText, attachments,
+		int64(imapEmail.Size), int64(len(data)), isRead, "")
+	htmlFilterKeep(folder, imapEmail.Uid, htmlText)
+	return nil
+}
+
+// downloads a section of an email, and returns it with whether the email is
+// read once it was downloaded
+func imapFetchSection(
+	clt *client.Client, uid uint32, section *imap.BodySectionName,
+) ([]byte, bool, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	chEmails := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.UidFetch(seqSet, []imap.FetchItem{
+			imap.FetchUid, imap.FetchFlags, section.FetchItem(),
+		}, chEmails)
+	}()
+
+	var buf bytes.Buffer
+	isRead := false
+	found := false
+	for imapEmail := range chEmails {
+		if reader := imapEmail.GetBody(section); reader != nil {
+			_, err := io.Copy(&buf, reader)
+			if err != nil {
+				return nil, false, fmt.Errorf(
+					"unable to copy email buffer: %v", err)
 			}
+			found = true
 		}
+		isRead = isRead || emailFromImapIsRead(imapEmail)
+	}
+	err := <-done
+	if err == nil && !found {
+		err = errors.New("email message has no body")
+	}
+	return buf.Bytes(), isRead, err
+}
+
+// the whole message was downloaded, for emails we need to verify or decrypt
+func updateEmailBodyFromRaw(
+	folder string, imapEmail *imap.Message, buf []byte, isRead bool,
+) error {
+	n := int64(len(buf))
+	raw, security := pgpProcessMessage(buf)
+	if security == "" {
+		raw, security = smimeProcessMessage(raw)
+	}
+
+	plainText, htmlText, attachments, err := emailBodyFromRaw(raw)
+	if err != nil {
+		return err
+	}
+
+	if plainText == "" && security != "" {
+		plainText = fmt.Sprintf("<%s>", security)
 	}
 
 	if plainText == "" {
@@ -563,11 +710,205 @@ func updateEmailBody(folder string, imapEmail *imap.Message) error {
 		)
 	}
 
-	isRead := emailFromImapIsRead(imapEmail)
-	cachedEmailBodyUpdate(folder, imapEmail.Uid, plainText, n, isRead)
+	cachedEmailBodyUpdate(
+		folder, imapEmail.Uid, plainText, attachments, n, n, isRead, security)
+	htmlFilterKeep(folder, imapEmail.Uid, htmlText)
 	return nil
 }
 
+// the text and attachments of a whole message, and the html the text was
+// rendered from when there was no text part. Unknown charsets and transfer
+// encodings still leave us with a readable part, we'll show what we can
+// rather than nothing
+func emailBodyFromRaw(raw []byte) (string, string, []Attachment, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !isUnknownCharsetOrEncoding(err) {
+		return "", "", nil, errors.New(fmt.Sprintf(
+			"unable to create reader: %v", err))
+	}
+
+	plainText := ""
+	htmlText := ""
+	var attachments []Attachment
+	err = mimeWalkParts(entity, func(part *mail.Part) error {
+		switch header := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, params, _ := header.ContentType()
+
+			if strings.Contains(contentType, "text/plain") {
+				plainText = decodeBodyText(part.Body)
+				if strings.EqualFold(params["format"], "flowed") {
+					plainText = flowedDecode(plainText,
+						strings.EqualFold(params["delsp"], "yes"))
+				}
+				break
+			}
+
+			if strings.Contains(contentType, "text/html") && htmlText == "" {
+				htmlText = decodeBodyText(part.Body)
+				break
+			}
+
+		case *mail.AttachmentHeader:
+			contentType, _, _ := header.ContentType()
+			// the signature was already checked, it's not for saving
+			if contentType == "application/pkcs7-signature" ||
+				contentType == "application/x-pkcs7-signature" {
+				break
+			}
+			filename, _ := header.Filename()
+			filename = decodeHeaderText(filename)
+			data, err := io.ReadAll(part.Body)
+			if err != nil {
+				return errors.New(fmt.Sprintf(
+					"unable to read attachment \"%s\": %v", filename, err))
+			}
+			attachments = append(attachments, Attachment{
+				filename:    filename,
+				contentType: contentType,
+				size:        int64(len(data)),
+				data:        data,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if plainText != "" {
+		return plainText, "", attachments, nil
+	}
+	return htmlToText(htmlText), htmlText, attachments, nil
+}
+
+// pgp and s/mime emails, which are downloaded whole
+func bodyStructureIsSecured(structure *imap.BodyStructure) bool {
+	switch strings.ToLower(structure.MIMEType + "/" + structure.MIMESubType) {
+	case "multipart/signed", "multipart/encrypted",
+		"application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+// the parts that aren't multipart containers, attached emails are a single
+// part rather than their own parts
+func bodyStructureLeaves(structure *imap.BodyStructure) []*MimePart {
+	if len(structure.Parts) == 0 {
+		return []*MimePart{{path: []int{1}, structure: structure}}
+	}
+	var leaves []*MimePart
+	var walk func(structure *imap.BodyStructure, path []int)
+	walk = func(structure *imap.BodyStructure, path []int) {
+		if len(structure.Parts) == 0 {
+			leaves = append(leaves, &MimePart{path: path, structure: structure})
+			return
+		}
+		for i, child := range structure.Parts {
+			walk(child, append(append([]int(nil), path...), i+1))
+		}
+	}
+	walk(structure, nil)
+	return leaves
+}
+
+// picks the part shown in the preview, the first plain text part or else the
+// first html one, and lists the attachments without their data. Which parts
+// are attachments is decided like go-message's mail reader does
+func bodyStructureTextPart(
+	structure *imap.BodyStructure,
+) (*MimePart, []Attachment) {
+	var plainPart, htmlPart *MimePart
+	var attachments []Attachment
+	for _, part := range bodyStructureLeaves(structure) {
+		contentType := strings.ToLower(
+			part.structure.MIMEType + "/" + part.structure.MIMESubType)
+		disposition := strings.ToLower(part.structure.Disposition)
+		if disposition == "inline" || (disposition != "attachment" &&
+			strings.HasPrefix(contentType, "text/")) {
+			if contentType == "text/plain" && plainPart == nil {
+				plainPart = part
+			}
+			if contentType == "text/html" && htmlPart == nil {
+				htmlPart = part
+			}
+			continue
+		}
+
+		if contentType == "application/pkcs7-signature" ||
+			contentType == "application/x-pkcs7-signature" {
+			continue
+		}
+		// base64 lines carry 57 bytes in 76 characters and a line break
+		size := int64(part.structure.Size)
+		if strings.EqualFold(part.structure.Encoding, "base64") {
+			size = size * 57 / 78
+		}
+		attachments = append(attachments, Attachment{
+			filename:    part.filename(),
+			contentType: contentType,
+			size:        size,
+			part:        part,
+		})
+	}
+
+	if plainPart != nil {
+		return plainPart, attachments
+	}
+	return htmlPart, attachments
+}
+
+// downloads the data of attachments that were only listed when the body was
+// downloaded, e.g. to forward them
+func fetchEmailAttachments(email Email) ([]Attachment, error) {
+	attachments := append([]Attachment(nil), email.attachments...)
+	for i, attachment := range attachments {
+		if attachment.data != nil || attachment.part == nil {
+			continue
+		}
+		data, err := fetchEmailPart(email.folder, email.uid, attachment.part)
+		if err != nil {
+			return nil, fmt.Errorf("unable to download \"%s\": %v",
+				attachment.filename, err)
+		}
+		attachments[i].data = data
+		attachments[i].size = int64(len(data))
+		attachments[i].part = nil
+	}
+	return attachments, nil
+}
+
+// the attachments of an email to forward, its body may have been evicted
+// since it was shown, so it's read back from disk or, e.g. when it was
+// decrypted, downloaded again
+func fetchEmailForwardAttachments(folder string, uid uint32) ([]Attachment,
+	error) {
+	email := cachedEmailFromUid(folder, uid)
+	if email.body == "" && !bodyCacheRestore(folder, uid) {
+		err := imapCommand(folder, func(clt *client.Client) error {
+			return prefetchBody(clt, folder, uid)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fetchEmailAttachments(cachedEmailFromUid(folder, uid))
+}
+
+func isUnknownCharsetOrEncoding(err error) bool {
+	return message.IsUnknownCharset(err) || message.IsUnknownEncoding(err)
+}
+
+func emailFromImapIsFlagged(imapEmail *imap.Message) bool {
+	for _, flag := range imapEmail.Flags {
+		if flag == imap.FlaggedFlag {
+			return true
+		}
+	}
+	return false
+}
+
 func emailFromImapIsRead(imapEmail *imap.Message) bool {
 	for _, flag := range imapEmail.Flags {
 		if flag == imap.SeenFlag {
@@ -579,27 +920,40 @@ func emailFromImapIsRead(imapEmail *imap.Message) bool {
 }
 
 func emailFromImapEmail(folder string, imapEmail *imap.Message) *Email {
+
 	email := Email{
 		uid:         imapEmail.Uid,
 		seqNum:      imapEmail.SeqNum,
 		folder:      getNormalizedImapFolderName(folder),
-		subject:     imapEmail.Envelope.Subject,
+		messageId:   imapEmail.Envelope.MessageId,
+		subject:     decodeHeaderText(imapEmail.Envelope.Subject),
 		date:        imapEmail.Envelope.Date,
+		arrival:     imapEmail.InternalDate,
 		toAddress:   "",
 		fromAddress: "",
 		fromName:    "",
 		body:        "",
-		size:        0,
+		size:        uint64(imapEmail.Size),
 		isRead:      emailFromImapIsRead(imapEmail),
+		isFlagged:   emailFromImapIsFlagged(imapEmail),
 	}
+	email.sortedUnread = !email.isRead
+	email.sortedFlagged = email.isFlagged
 
 	if len(imapEmail.Envelope.To) > 0 {
 		email.toAddress = imapEmail.Envelope.To[0].Address()
 	}
 
+	var ccAddresses []string
+	for _, address := range imapEmail.Envelope.Cc {
+		ccAddresses = append(ccAddresses, address.Address())
+	}
+	email.ccAddress = strings.Join(ccAddresses, ", ")
+
 	if len(imapEmail.Envelope.From) > 0 {
 		email.fromAddress = imapEmail.Envelope.From[0].Address()
-		email.fromName = imapEmail.Envelope.From[0].PersonalName
+		email.fromName = decodeHeaderText(
+			imapEmail.Envelope.From[0].PersonalName)
 	}
 
 	return &email
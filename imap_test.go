@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// an empty cache with its files under a temporary data directory
+func testModelInit(t *testing.T) {
+	t.Helper()
+	g_config = MailConfig{DataDir: t.TempDir()}
+	modelInit()
+}
+
+// downloads raw into the cache as the body of a new email in the inbox
+func testUpdateEmailBodyFromRaw(t *testing.T, uid uint32, raw string) Email {
+	t.Helper()
+	cachedEmailEnvelopeSet(&Email{uid: uid, folder: "Inbox"})
+	err := updateEmailBodyFromRaw("Inbox", &imap.Message{Uid: uid},
+		[]byte(strings.ReplaceAll(raw, "\n", "\r\n")), true)
+	if err != nil {
+		t.Fatalf("updateEmailBodyFromRaw: %v", err)
+	}
+	return cachedEmailFromUid("Inbox", uid)
+}
+
+func TestUpdateEmailBodyFromRawCharsets(t *testing.T) {
+	testModelInit(t)
+	uid := uint32(0)
+	for _, cs := range testCharsets {
+		for _, transfer := range testTransferEncodings {
+			body, text := testEncodeBody(t, cs.encoding, cs.text, transfer)
+			raw := fmt.Sprintf("Subject: test\n"+
+				"Content-Type: text/plain; charset=%s\n"+
+				"Content-Transfer-Encoding: %s\n"+
+				"\n%s\n", cs.name, transfer, body)
+			uid++
+			email := testUpdateEmailBodyFromRaw(t, uid, raw)
+			if strings.TrimSpace(email.body) != text {
+				t.Errorf("%s %s: body %q, want %q", cs.name, transfer,
+					email.body, text)
+			}
+		}
+	}
+}
+
+func TestUpdateEmailBodyFromRawUnknownEncoding(t *testing.T) {
+	testModelInit(t)
+
+	email := testUpdateEmailBodyFromRaw(t, 1, "Subject: test\n"+
+		"Content-Type: text/plain; charset=utf-8\n"+
+		"Content-Transfer-Encoding: x-uuencode\n"+
+		"\nbegin 644 hi.txt\n")
+	if !strings.Contains(email.body, "begin 644 hi.txt") {
+		t.Errorf("unknown encoding: body %q, want it as it came", email.body)
+	}
+
+	email = testUpdateEmailBodyFromRaw(t, 2, "Subject: test\n"+
+		"Content-Type: multipart/mixed; boundary=b\n"+
+		"\n--b\n"+
+		"Content-Type: text/plain; charset=x-nope\n"+
+		"\nhello\n"+
+		"--b\n"+
+		"Content-Type: application/octet-stream\n"+
+		"Content-Disposition: attachment; filename=a.bin\n"+
+		"Content-Transfer-Encoding: x-uuencode\n"+
+		"\nbegin 644 a.bin\n"+
+		"--b--\n")
+	if strings.TrimSpace(email.body) != "hello" {
+		t.Errorf("unknown charset: body %q, want %q", email.body, "hello")
+	}
+	if len(email.attachments) != 1 ||
+		email.attachments[0].filename != "a.bin" ||
+		!strings.Contains(string(email.attachments[0].data), "begin 644") {
+		t.Errorf("unknown encoding: attachments %+v, want a.bin as it came",
+			email.attachments)
+	}
+}
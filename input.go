@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
 	"github.com/gdamore/tcell/v2"
-	"github.com/rivo/tview"
 )
 
 func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
@@ -18,10 +20,45 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 		}
 
 		if event.Key() == tcell.KeyF5 {
+			if g_ui.folderSelected == outboxFolder {
+				outboxFolderShow()
+				return nil
+			}
 			go fetchFolder(g_ui.folderSelected, fetchFolderOptionLatestOnly)
 			return nil
 		}
 
+		if g_ui.folderSelected == outboxFolder && pane == g_ui.emailsTable {
+			switch {
+			case event.Key() == tcell.KeyDelete:
+				outboxCancelSelected()
+				return nil
+			case event.Key() == tcell.KeyRune && event.Rune() == 'e':
+				outboxEditSelected()
+				return nil
+			}
+		}
+
+		if pane == g_ui.foldersList && event.Key() == tcell.KeyRune {
+			switch event.Rune() {
+			case 'n':
+				folderCreatePrompt()
+				return nil
+			case 'R':
+				folderRenamePrompt()
+				return nil
+			case 'D':
+				folderDeletePrompt()
+				return nil
+			case 's':
+				folderToggleSubscribed()
+				return nil
+			case 'S':
+				foldersToggleShowAll()
+				return nil
+			}
+		}
+
 		ctrlLetter := event.Modifiers()&tcell.ModCtrl != 0
 
 		if event.Key() == tcell.KeyRune || ctrlLetter {
@@ -34,11 +71,15 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 			}
 
 			switch char {
-			case 'r':
+			case 'r', 'i':
 				if g_ui.previewUid != 0 {
 					if g_ui.previewVisible == false {
 						togglePreviewBar()
 					}
+					if g_ui.previewView != previewViewBody {
+						previewPaneSetView(previewViewBody)
+					}
+					g_ui.quickReplyInline = char == 'i'
 					setUIMode(UIModeQuickReply)
 					previewPaneSetReply()
 				} else {
@@ -47,8 +88,7 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 				return nil
 
 			case 'f':
-				setUIMode(UIModeCompose)
-				composeSetForward()
+				forwardSelected()
 				return nil
 
 			case 'd':
@@ -68,6 +108,78 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 				composeClear()
 				return nil
 
+			case 'u':
+				undoLast()
+				return nil
+
+			case 'x':
+				markToggleSelected()
+				return nil
+
+			case 'X':
+				markRange()
+				return nil
+
+			case '*':
+				markAllShown()
+				return nil
+
+			case 'T':
+				markThread()
+				return nil
+
+			case 'M':
+				bulkMovePrompt()
+				return nil
+
+			case 'a':
+				bulkMoveSelected(archiveFolder(), "archive")
+				return nil
+
+			case '#':
+				bulkMoveSelected(trashFolder(), "delete")
+				return nil
+
+			case '!':
+				bulkMoveSelected(junkFolder(), "junk")
+				return nil
+
+			case 's':
+				bulkToggleFlagSelected(imap.FlaggedFlag)
+				return nil
+
+			case 'I':
+				bulkSetFlagSelected(imap.SeenFlag, true)
+				return nil
+
+			case 'U':
+				bulkSetFlagSelected(imap.SeenFlag, false)
+				return nil
+
+			case 'z':
+				snoozeSelected()
+				return nil
+
+			case 'v':
+				previewPaneCycleView()
+				return nil
+
+			case 'm':
+				mimeTreeShowSelected()
+				return nil
+
+			case 'o':
+				emailsTableSortCycle()
+				return nil
+
+			case 'O':
+				emailsTableSortReverse()
+				return nil
+
+			case '/':
+				filterShow()
+				return nil
+
 			case 'q':
 				g_ui.app.Stop()
 				return nil
@@ -80,7 +192,11 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 		case tcell.KeyCtrlJ: // this is sent on ^enter
 			email := cachedEmailFromUid(
 				g_ui.folderSelected, g_ui.previewUid)
-			replyEmail(email, g_ui.previewText.GetText())
+			body := g_ui.previewText.GetText()
+			if g_ui.quickReplyInline {
+				body = inlineReplyPrepare(body, g_ui.quickReplyQuoted)
+			}
+			replyEmail(email, body)
 			setUIMode(UIModeNormal)
 			g_ui.previewText.SetText("", false)
 			row, _ := g_ui.emailsTable.GetSelection()
@@ -93,29 +209,73 @@ func KeyHandler(event *tcell.EventKey) *tcell.EventKey {
 			g_ui.previewText.SetText("", false)
 			g_ui.app.SetFocus(g_ui.emailsTable)
 			return nil
+
+		case tcell.KeyEnter:
+			if g_ui.quickReplyInline &&
+				inlineReplySplitAtCursor(g_ui.previewText) {
+				return nil
+			}
+		}
+	}
+
+	if mode == UIModeFilter && filterKeyHandler(event) == nil {
+		return nil
+	}
+
+	if mode == UIModeMimeTree {
+		switch {
+		case event.Key() == tcell.KeyEsc:
+			setUIMode(UIModeNormal)
+			return nil
+
+		case event.Key() == tcell.KeyTab || event.Key() == tcell.KeyBacktab:
+			if pane == g_ui.mimeTree {
+				g_ui.app.SetFocus(g_ui.mimePartText)
+			} else {
+				g_ui.app.SetFocus(g_ui.mimeTree)
+			}
+			onFocusChange()
+			return nil
+
+		case event.Key() == tcell.KeyRune && event.Rune() == 's':
+			mimeTreeSaveSelected()
+			return nil
+
+		case event.Key() == tcell.KeyRune && event.Rune() == '|':
+			mimeTreePipeSelected()
+			return nil
 		}
 	}
 
 	if mode == UIModeCompose {
 		switch event.Key() {
 		case tcell.KeyCtrlJ:
-			fnGetFormItem := g_ui.composeForm.GetFormItem
-			email := Email{
-				toAddress: fnGetFormItem(0).(*tview.InputField).GetText(),
-				ccAddress: fnGetFormItem(1).(*tview.InputField).GetText(),
-				subject:   fnGetFormItem(2).(*tview.InputField).GetText(),
-				body:      fnGetFormItem(3).(*tview.TextArea).GetText(),
+			email, err := composeEmailFromForm()
+			if err != nil {
+				updateStatusBar(fmt.Sprintf("Can't send email: %v", err))
+				return nil
+			}
+
+			if g_ui.composeOutboxId != 0 {
+				outboxCancel(g_ui.composeOutboxId)
+				g_ui.composeOutboxId = 0
 			}
 			setUIMode(UIModeNormal)
 			composeEmail(email)
+			composeSetFields("", "", "", "")
+			return nil
 
-			fnGetFormItem(0).(*tview.InputField).SetText("")
-			fnGetFormItem(1).(*tview.InputField).SetText("")
-			fnGetFormItem(2).(*tview.InputField).SetText("")
-			fnGetFormItem(3).(*tview.TextArea).SetText("", true)
+		case tcell.KeyCtrlP:
+			if composeCheckbox(composeLabelMarkdown).IsChecked() {
+				composeSetMarkdownPreviewVisible(!g_ui.composePreviewVisible)
+			}
 			return nil
 
 		case tcell.KeyEsc:
+			if g_ui.composeOutboxId != 0 {
+				outboxRelease(g_ui.composeOutboxId)
+				g_ui.composeOutboxId = 0
+			}
 			setUIMode(UIModeNormal)
 			return nil
 		}
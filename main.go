@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/BurntSushi/toml"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
@@ -20,17 +21,42 @@ func main() {
 	defer f.Close()
 	log.SetOutput(f)
 
+	meta, err := toml.DecodeFile("kagimail.toml", &g_config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !meta.IsDefined("send_delay_seconds") {
+		g_config.SendDelaySeconds = sendDelaySecondsDefault
+	}
+	if !meta.IsDefined("prefetch_nearby") {
+		g_config.PrefetchNearby = prefetchNearbyDefault
+	}
+	if !meta.IsDefined("prefetch_unread") {
+		g_config.PrefetchUnread = prefetchUnreadDefault
+	}
+	if !meta.IsDefined("prefetch_budget_mb") {
+		g_config.PrefetchBudgetMB = prefetchBudgetMBDefault
+	}
+
 	modelInit()
+	contactsInit()
+	snoozeInit()
 
 	g_ui.app = tview.NewApplication()
+	g_ui.markedUids = make(map[uint32]bool)
 
 	g_ui.foldersList = tview.NewList()
 	g_ui.foldersList.SetSelectedFunc(
-		func(_ int, main string, _ string, _ rune) {
+		func(i int, _ string, _ string, _ rune) {
 			if g_ui.folderDownloadCancel != nil {
 				g_ui.folderDownloadCancel()
 			}
-			go fetchFolder(main, fetchFolderOptionAllEmails)
+			folder := g_ui.foldersShown[i]
+			if folder == outboxFolder {
+				outboxFolderShow()
+				return
+			}
+			go fetchFolder(folder, fetchFolderOptionAllEmails)
 		},
 	)
 
@@ -56,11 +82,20 @@ func main() {
 		SetBorder(true).
 		SetTitle("Preview")
 
+	g_ui.filterInput = tview.NewInputField()
+	g_ui.filterInput.
+		SetChangedFunc(onFilterChanged).
+		SetLabelColor(tcell.GetColor(coEmailUnread)).
+		SetFieldBackgroundColor(tcell.GetColor(coSelectionInactive)).
+		SetFieldTextColor(tcell.GetColor(coSelectionTextInactive))
+	filterSetLabel()
+
 	g_ui.emailsFrame = tview.NewFrame(g_ui.emailsTable).
 		SetBorders(0, 0, 1, 0, 1, 1)
 	updateEmailStatusBarWithSelection()
 	g_ui.emailsPane = tview.NewFlex().SetDirection(tview.FlexRow).
 		AddItem(g_ui.hintsBar, 0, 0, false).
+		AddItem(g_ui.filterInput, 0, 0, false).
 		AddItem(g_ui.emailsFrame, 0, 7, false).
 		AddItem(g_ui.previewText, 0, 0, false)
 	toggleHintsBar()
@@ -80,24 +115,99 @@ func main() {
 	g_ui.pages = tview.NewPages()
 	g_ui.pages.AddPage("main", g_ui.mainPane, true, true)
 
+	g_ui.promptInput = tview.NewInputField()
+	g_ui.promptInput.
+		SetLabelColor(tcell.GetColor(coEmailUnread)).
+		SetFieldBackgroundColor(tcell.GetColor(coSelectionFocused)).
+		SetFieldTextColor(tcell.GetColor(coSelectionTextFocused)).
+		SetBorder(true).
+		SetBorderColor(tcell.GetColor(coSelectionFocused))
+	promptPane := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().
+			AddItem(nil, 0, 1, false).
+			AddItem(g_ui.promptInput, 0, 3, true).
+			AddItem(nil, 0, 1, false), 3, 0, true).
+		AddItem(nil, 0, 1, false)
+
+	g_ui.mimeTree = tview.NewTreeView()
+	g_ui.mimeTree.
+		SetSelectedFunc(mimeTreeShowPart).
+		SetBorder(true)
+	g_ui.mimePartText = tview.NewTextView()
+	g_ui.mimePartText.
+		SetWrap(true).
+		SetBorder(true)
+	g_ui.mimePane = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(g_ui.hintsBar, 1, 0, false).
+		AddItem(tview.NewFlex().
+			AddItem(g_ui.mimeTree, 0, 1, true).
+			AddItem(g_ui.mimePartText, 0, 2, false), 0, 1, true).
+		AddItem(g_ui.statusBar, 1, 0, false)
+	g_ui.pages.AddPage("mime", g_ui.mimePane, true, false)
+	g_ui.pages.AddPage("prompt", promptPane, true, false)
+
 	g_ui.composeForm = tview.NewForm()
 	g_ui.composeForm.
 		SetBorder(true).
 		SetTitle("Compose").
 		SetTitleAlign(tview.AlignLeft)
 
-	g_ui.composeForm.AddInputField("To:", "", 0, nil, nil)
-	g_ui.composeForm.AddInputField("Cc:", "", 0, nil, nil)
-	g_ui.composeForm.AddInputField("Subject:", "", 0, nil, nil)
-	g_ui.composeForm.AddTextArea("Message:", "", 0, 14, 0, nil)
+	g_ui.composeIdentity = identityDefault()
+	var identityOptions []string
+	for _, identity := range identities() {
+		identityOptions = append(identityOptions, identity.String())
+	}
+	g_ui.composeForm.AddDropDown(composeLabelFrom, identityOptions, 0,
+		onComposeIdentitySelected)
+	g_ui.composeForm.AddInputField(composeLabelTo, "", 0, nil, nil)
+	g_ui.composeForm.AddInputField(composeLabelCc, "", 0, nil, nil)
+	g_ui.composeForm.AddInputField(composeLabelBcc, "", 0, nil, nil)
+	for _, label := range composeAddressLabels {
+		field := composeInputField(label)
+		field.SetAutocompleteFunc(contactsCompleteAddressField).
+			SetAutocompletedFunc(onContactsAddressAutocompleted(field)).
+			SetChangedFunc(func(_ string) {
+				composeUpdateTitle()
+				composeApplyEncryptPolicy()
+			})
+	}
+	g_ui.composeForm.AddInputField(composeLabelSubject, "", 0, nil, nil)
+	g_ui.composeForm.AddInputField(composeLabelAttach, "", 0, nil,
+		func(_ string) { composeUpdateTitle() })
+	composeInputField(composeLabelAttach).
+		SetPlaceholder("comma separated file paths").
+		SetAutocompleteFunc(composeCompleteAttachmentPath)
+	g_ui.composeForm.AddInputField(composeLabelSendAt, "", 0, nil, nil)
+	composeInputField(composeLabelSendAt).
+		SetPlaceholder("now, or e.g. +2h, tomorrow 9am, fri 17:30")
+	g_ui.composeForm.AddCheckbox(composeLabelMarkdown, g_config.Markdown,
+		onComposeMarkdownChanged)
+	g_ui.composeForm.AddCheckbox(composeLabelSign, g_config.PGPSign, nil)
+	g_ui.composeForm.AddCheckbox(composeLabelEncrypt,
+		g_config.PGPEncrypt == pgpEncryptAlways, onComposeEncryptChanged)
+	g_ui.composeForm.AddCheckbox(composeLabelSMIME, g_config.SMIMESign, nil)
+	g_ui.composeForm.AddTextArea(composeLabelMessage, "", 0, 14, 0, nil)
+	composeTextArea(composeLabelMessage).
+		SetChangedFunc(composeUpdateMarkdownPreview)
 	g_ui.composeForm.SetLabelColor(tcell.GetColor(coEmailUnread))
 	g_ui.composeForm.SetFieldBackgroundColor(tcell.GetColor(coSelectionFocused))
 	g_ui.composeForm.SetFieldTextColor(tcell.GetColor(coSelectionTextFocused))
 
+	g_ui.composePreview = tview.NewTextView()
+	g_ui.composePreview.
+		SetWrap(true).
+		SetWordWrap(true).
+		SetBorder(true).
+		SetTitle("Markdown Preview")
+	g_ui.composeColumns = tview.NewFlex().
+		AddItem(g_ui.composeForm, 0, 1, true).
+		AddItem(g_ui.composePreview, 0, 0, false)
+
 	g_ui.composePane = tview.NewFlex()
 	g_ui.composePane.SetDirection(tview.FlexRow).
 		AddItem(g_ui.hintsBar, 1, 0, false).
-		AddItem(g_ui.composeForm, 0, 1, true)
+		AddItem(g_ui.composeColumns, 0, 1, true)
 	g_ui.pages.AddPage("compose", g_ui.composePane, true, false)
 
 	g_ui.app.SetInputCapture(KeyHandler)
@@ -114,4 +224,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// contacts are otherwise only saved every contactsSaveInterval
+	contactsSave()
+	bodyCacheClear()
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	gohtml "html"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// raw html in the markdown is escaped rather than passed through, and line
+// breaks are kept since they're usually meant in email
+var g_markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(html.WithHardWraps(),
+		renderer.WithNodeRenderers(
+			util.Prioritized(markdownEscapeHTML{}, 100))),
+)
+
+// goldmark would leave raw html out altogether, the text of the email should
+// still read as it was typed, e.g. "use <b> for bold"
+type markdownEscapeHTML struct{}
+
+func (markdownEscapeHTML) RegisterFuncs(
+	registerer renderer.NodeRendererFuncRegisterer,
+) {
+	registerer.Register(ast.KindRawHTML, markdownRenderRawHTML)
+	registerer.Register(ast.KindHTMLBlock, markdownRenderHTMLBlock)
+}
+
+func markdownRenderRawHTML(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	if entering {
+		segments := node.(*ast.RawHTML).Segments
+		for i := 0; i < segments.Len(); i++ {
+			segment := segments.At(i)
+			_, _ = w.WriteString(gohtml.EscapeString(
+				string(segment.Value(source))))
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// blocks are shown as a paragraph, keeping their line breaks
+func markdownRenderHTMLBlock(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	block := node.(*ast.HTMLBlock)
+	var text strings.Builder
+	for i := 0; i < block.Lines().Len(); i++ {
+		line := block.Lines().At(i)
+		text.Write(line.Value(source))
+	}
+	if block.HasClosure() {
+		text.Write(block.ClosureLine.Value(source))
+	}
+	_, _ = w.WriteString("<p>" + strings.ReplaceAll(
+		gohtml.EscapeString(strings.TrimRight(text.String(), "\r\n")),
+		"\n", "<br>\n") + "</p>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// renders an email body written in markdown as an html document, the
+// signature is kept as it was written
+func markdownToHTML(text string) (string, error) {
+	body, signature := text, ""
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r") == signatureDelimiter {
+			body = strings.Join(lines[:i], "\n")
+			signature = strings.Join(lines[i+1:], "\n")
+			break
+		}
+	}
+
+	var rendered bytes.Buffer
+	err := g_markdown.Convert([]byte(body), &rendered)
+	if err != nil {
+		return "", fmt.Errorf("unable to render markdown: %v", err)
+	}
+
+	var document strings.Builder
+	document.WriteString("<!DOCTYPE html>\n<html><head>")
+	document.WriteString(`<meta charset="utf-8">`)
+	document.WriteString("</head><body>\n")
+	document.Write(rendered.Bytes())
+	if signature = strings.Trim(signature, "\n"); signature != "" {
+		document.WriteString("<p>-- <br>\n")
+		document.WriteString(strings.ReplaceAll(
+			gohtml.EscapeString(signature), "\n", "<br>\n"))
+		document.WriteString("</p>\n")
+	}
+	document.WriteString("</body></html>\n")
+	return document.String(), nil
+}
+
+// how the html part will read, shown beside compose while writing markdown
+func composeUpdateMarkdownPreview() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if !g_ui.composePreviewVisible {
+		return
+	}
+	rendered, err := markdownToHTML(
+		composeTextArea(composeLabelMessage).GetText())
+	if err != nil {
+		g_ui.composePreview.SetText(err.Error())
+		return
+	}
+	g_ui.composePreview.SetText(htmlToText(rendered))
+}
+
+func composeSetMarkdownPreviewVisible(visible bool) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	g_ui.composePreviewVisible = visible
+	proportion := 0
+	if g_ui.composePreviewVisible {
+		proportion = 1
+	}
+	g_ui.composeColumns.ResizeItem(g_ui.composePreview, 0, proportion)
+	composeUpdateMarkdownPreview()
+	setHintsBarText()
+}
+
+func onComposeMarkdownChanged(checked bool) {
+	if !checked {
+		composeSetMarkdownPreviewVisible(false)
+	}
+	setHintsBarText()
+}
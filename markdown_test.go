@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownToHTMLEscapesRawHTML(t *testing.T) {
+	tests := []struct {
+		markdown string
+		want     string
+	}{
+		{"use <b>bold</b> here", "use &lt;b&gt;bold&lt;/b&gt; here"},
+		{"<div>\nhi <script>x</script>\n</div>",
+			"<p>&lt;div&gt;<br>\nhi &lt;script&gt;x&lt;/script&gt;<br>\n" +
+				"&lt;/div&gt;</p>"},
+		{"**bold**", "<strong>bold</strong>"},
+		{"one\ntwo", "one<br>\ntwo"},
+	}
+	for _, test := range tests {
+		got, err := markdownToHTML(test.markdown)
+		if err != nil {
+			t.Fatalf("markdownToHTML(%q): %v", test.markdown, err)
+		}
+		if !strings.Contains(got, test.want) {
+			t.Errorf("markdownToHTML(%q) = %q, want it to contain %q",
+				test.markdown, got, test.want)
+		}
+		if strings.Contains(got, "<script>") || strings.Contains(got,
+			"raw HTML omitted") {
+			t.Errorf("markdownToHTML(%q) = %q, has raw html", test.markdown,
+				got)
+		}
+	}
+}
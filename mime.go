@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// random boundary for the multipart bodies we build by hand
+func mimeBoundary() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// splits a rendered message into the headers that stay on the outside, and
+// the content entity that's signed or encrypted, i.e. the Content-* headers
+// and the body
+func mimeSplitMessage(raw []byte) (textproto.Header, []byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(reader)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	var content textproto.Header
+	fields := header.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			content.Add(fields.Key(), fields.Value())
+			fields.Del()
+		}
+	}
+
+	var entity bytes.Buffer
+	err = textproto.WriteHeader(&entity, content)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	entity.Write(body)
+	return header, entity.Bytes(), nil
+}
+
+// signatures are over the entity with crlf line endings, as it's sent
+func mimeCanonicalize(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// the exact bytes of the first part of a multipart body, which is what a
+// multipart/signed signature covers, the line break before the next
+// boundary belongs to the boundary
+func mimeFirstPart(body []byte, boundary string) ([]byte, error) {
+	delimiter := []byte("--" + boundary)
+	start := bytes.Index(body, delimiter)
+	if start == -1 || (start > 0 && body[start-1] != '\n') {
+		return nil, errors.New("signed part not found")
+	}
+	start += len(delimiter)
+	lineEnd := bytes.IndexByte(body[start:], '\n')
+	if lineEnd == -1 {
+		return nil, errors.New("signed part not found")
+	}
+	start += lineEnd + 1
+
+	end := bytes.Index(body[start:], append([]byte("\n"), delimiter...))
+	if end == -1 {
+		return nil, errors.New("signed part isn't terminated")
+	}
+	part := body[start : start+end]
+	return bytes.TrimSuffix(part, []byte("\r")), nil
+}
+
+// the body of the nth part of a multipart message
+func mimePartBody(raw []byte, n int) ([]byte, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !isUnknownCharsetOrEncoding(err) {
+		return nil, err
+	}
+	multipart := entity.MultipartReader()
+	if multipart == nil {
+		return nil, errors.New("not a multipart message")
+	}
+	for i := 0; ; i++ {
+		part, err := multipart.NextPart()
+		if err != nil {
+			return nil, fmt.Errorf("part %d not found: %v", n, err)
+		}
+		if i == n {
+			return io.ReadAll(part.Body)
+		}
+	}
+}
+
+// puts entity under the headers of a message in place of its content, e.g.
+// the decrypted entity of an encrypted email
+func mimeReplaceEntity(header textproto.Header, entity []byte) ([]byte, error) {
+	fields := header.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			fields.Del()
+		}
+	}
+	var message bytes.Buffer
+	err := textproto.WriteHeader(&message, header)
+	if err != nil {
+		return nil, err
+	}
+	message.Write(entity)
+	return message.Bytes(), nil
+}
+
+// the body of a multipart/signed message, the signed entity as is followed
+// by the signature part
+func mimeSignedBody(
+	entity []byte, boundary string, signatureHeader string, signature []byte,
+) []byte {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "--%s\r\n", boundary)
+	body.Write(entity)
+	fmt.Fprintf(&body, "\r\n--%s\r\n", boundary)
+	body.WriteString(signatureHeader + "\r\n")
+	body.Write(mimeCanonicalize(signature))
+	fmt.Fprintf(&body, "\r\n--%s--\r\n", boundary)
+	return body.Bytes()
+}
+
+// visits the leaf parts of a message the way mail.Reader hands them out,
+// except that parts in a transfer encoding we don't know aren't an error, or
+// a nil part, their body is given as it came
+func mimeWalkParts(entity *message.Entity, visit func(*mail.Part) error) error {
+	multipart := entity.MultipartReader()
+	if multipart == nil {
+		part := &mail.Part{Body: entity.Body}
+		contentType, _, _ := entity.Header.ContentType()
+		disposition, _, _ := entity.Header.ContentDisposition()
+		if disposition == "inline" || (disposition != "attachment" &&
+			strings.HasPrefix(contentType, "text/")) {
+			part.Header = &mail.InlineHeader{Header: entity.Header}
+		} else {
+			part.Header = &mail.AttachmentHeader{Header: entity.Header}
+		}
+		return visit(part)
+	}
+
+	for {
+		child, err := multipart.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil && !isUnknownCharsetOrEncoding(err) {
+			return fmt.Errorf("unable to read all parts of emails: %v", err)
+		}
+		err = mimeWalkParts(child, visit)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the address in the from header, which signatures need to be from
+func mimeFromAddress(header textproto.Header) string {
+	parser := netmail.AddressParser{WordDecoder: headerWordDecoder}
+	address, err := parser.Parse(header.Get("From"))
+	if err != nil {
+		return ""
+	}
+	return address.Address
+}
+
+// undoes the content transfer encoding of a part downloaded on its own
+func mimeDecodeTransfer(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding,
+			bytes.NewReader(data)))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	}
+	return data, nil
+}
+
+// converts text in the charset it was sent in to utf-8
+func mimeDecodeCharset(charsetName string, data []byte) string {
+	if charsetName != "" {
+		reader, err := charset.Reader(charsetName, bytes.NewReader(data))
+		if err == nil {
+			converted, err := io.ReadAll(reader)
+			if err == nil {
+				return decodeAsUTF8(string(converted))
+			}
+		}
+	}
+	return decodeAsUTF8(string(data))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMimeDecodeCharsetAndTransfer(t *testing.T) {
+	for _, cs := range testCharsets {
+		for _, transfer := range testTransferEncodings {
+			data, text := testEncodeBody(t, cs.encoding, cs.text, transfer)
+			decoded, err := mimeDecodeTransfer(transfer, data)
+			if err != nil {
+				t.Fatalf("%s %s: mimeDecodeTransfer: %v", cs.name, transfer,
+					err)
+			}
+			got := mimeDecodeCharset(cs.name, decoded)
+			if got != text {
+				t.Errorf("%s %s: got %q, want %q", cs.name, transfer, got,
+					text)
+			}
+		}
+	}
+}
+
+func TestMimeDecodeTransfer(t *testing.T) {
+	tests := []struct {
+		encoding string
+		in       string
+		want     string
+	}{
+		{"BASE64", "aGVsbG8=", "hello"},
+		{"Quoted-Printable", "caf=C3=A9=\r\nlatte", "cafélatte"},
+		{"8bit", "as is", "as is"},
+		{"", "as is", "as is"},
+		{"x-uuencode", "begin 644 a\n", "begin 644 a\n"},
+	}
+	for _, test := range tests {
+		got, err := mimeDecodeTransfer(test.encoding, []byte(test.in))
+		if err != nil {
+			t.Errorf("mimeDecodeTransfer(%q): %v", test.encoding, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("mimeDecodeTransfer(%q, %q) = %q, want %q",
+				test.encoding, test.in, got, test.want)
+		}
+	}
+
+	_, err := mimeDecodeTransfer("base64", []byte("not base64!"))
+	if err == nil {
+		t.Errorf("mimeDecodeTransfer of broken base64 didn't fail")
+	}
+}
+
+func TestMimeDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name    string
+		charset string
+		in      string
+		want    string
+	}{
+		{"no charset, utf-8", "", "café", "café"},
+		{"no charset, 8-bit", "", "caf\xe9", "café"},
+		{"unknown charset", "x-nope", "caf\xe9", "café"},
+		{"charset names are case insensitive", "iso-8859-1", "caf\xe9",
+			"café"},
+	}
+	for _, test := range tests {
+		got := mimeDecodeCharset(test.charset, []byte(test.in))
+		if got != test.want {
+			t.Errorf("%s: mimeDecodeCharset(%q, %q) = %q, want %q",
+				test.name, test.charset, test.in, got, test.want)
+		}
+	}
+}
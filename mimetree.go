@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rivo/tview"
+)
+
+// a part picked in the mime tree, path is its imap part number e.g. [1 2]
+// for "1.2", and empty for the whole message
+type MimePart struct {
+	path      []int
+	structure *imap.BodyStructure
+}
+
+func (part *MimePart) name() string {
+	if len(part.path) == 0 {
+		return "message"
+	}
+	var numbers []string
+	for _, n := range part.path {
+		numbers = append(numbers, strconv.Itoa(n))
+	}
+	return strings.Join(numbers, ".")
+}
+
+// what a saved part is called unless another path is given, parts without a
+// filename are named after their part number
+func (part *MimePart) filename() string {
+	filename, _ := part.structure.Filename()
+	filename = filepath.Base(decodeHeaderText(filename))
+	if filename == "." || filename == "/" || filename == "" {
+		return "part-" + part.name()
+	}
+	return filename
+}
+
+func (part *MimePart) label() string {
+	structure := part.structure
+	fields := []string{part.name(), strings.ToLower(
+		structure.MIMEType + "/" + structure.MIMESubType)}
+	if structure.Encoding != "" && !strings.EqualFold(structure.MIMEType,
+		"multipart") {
+		fields = append(fields, strings.ToLower(structure.Encoding))
+	}
+	if structure.Size > 0 {
+		fields = append(fields,
+			FormatHumanReadableSize(int64(structure.Size)))
+	}
+	if charsetName := structure.Params["charset"]; charsetName != "" {
+		fields = append(fields, "charset="+charsetName)
+	}
+	if structure.Disposition != "" {
+		fields = append(fields, strings.ToLower(structure.Disposition))
+	}
+	if filename, _ := structure.Filename(); filename != "" {
+		fields = append(fields, strconv.Quote(decodeHeaderText(filename)))
+	}
+	return strings.Join(fields, "  ")
+}
+
+func fetchEmailStructure(folder string, uid uint32) (*imap.BodyStructure,
+	error) {
+	var structure *imap.BodyStructure
+	err := imapCommand(folder, func(clt *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		chEmails := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- clt.UidFetch(seqSet,
+				[]imap.FetchItem{imap.FetchBodyStructure}, chEmails)
+		}()
+		for imapEmail := range chEmails {
+			structure = imapEmail.BodyStructure
+		}
+		return <-done
+	})
+	if err == nil && structure == nil {
+		err = fmt.Errorf("email %d is no longer in %s", uid, folder)
+	}
+	return structure, err
+}
+
+// downloads a single part and undoes its transfer encoding, the charset is
+// left as it is
+func fetchEmailPart(folder string, uid uint32, part *MimePart) ([]byte,
+	error) {
+	var data []byte
+	err := imapCommand(folder, func(clt *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		section := &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Path: part.path},
+			Peek:         true,
+		}
+		chEmails := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- clt.UidFetch(seqSet,
+				[]imap.FetchItem{section.FetchItem()}, chEmails)
+		}()
+		for imapEmail := range chEmails {
+			if reader := imapEmail.GetBody(section); reader != nil {
+				var buf bytes.Buffer
+				_, err := buf.ReadFrom(reader)
+				if err != nil {
+					return err
+				}
+				data = buf.Bytes()
+			}
+		}
+		return <-done
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("part %s is missing from email %d",
+			part.name(), uid)
+	}
+
+	// the whole message is as it is on the server, headers and all
+	if len(part.path) == 0 {
+		return data, nil
+	}
+	return mimeDecodeTransfer(part.structure.Encoding, data)
+}
+
+// text parts are converted from their charset, anything else that isn't
+// text is shown as a hex dump
+func mimePartText(part *MimePart, data []byte) string {
+	if len(part.path) > 0 && part.structure.Params["charset"] != "" {
+		return mimeDecodeCharset(part.structure.Params["charset"], data)
+	}
+	if utf8.Valid(data) || strings.EqualFold(part.structure.MIMEType, "text") {
+		return decodeAsUTF8(string(data))
+	}
+	return hex.Dump(data)
+}
+
+// the parts of a message/rfc822 part are numbered under it, so the body of
+// an attached email in part 2 is 2.1
+func mimeTreeNode(structure *imap.BodyStructure, path []int) *tview.TreeNode {
+	part := &MimePart{path: path, structure: structure}
+	node := tview.NewTreeNode(part.label()).SetReference(part)
+
+	children := structure.Parts
+	if structure.BodyStructure != nil {
+		children = structure.BodyStructure.Parts
+		if len(children) == 0 {
+			children = []*imap.BodyStructure{structure.BodyStructure}
+		}
+	}
+	for i, child := range children {
+		childPath := append(append([]int(nil), path...), i+1)
+		node.AddChild(mimeTreeNode(child, childPath))
+	}
+	return node
+}
+
+func mimeTreeRoot(structure *imap.BodyStructure) *tview.TreeNode {
+	root := mimeTreeNode(structure, nil)
+	// a message that isn't multipart only has its body as part 1
+	if len(structure.Parts) == 0 {
+		root.AddChild(mimeTreeNode(structure, []int{1}))
+	}
+	return root
+}
+
+// opens the mime tree of the selected email in place of the main pane
+func mimeTreeShowSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.previewUid == 0 || g_ui.folderSelected == outboxFolder {
+		updateStatusBar("No message selected to show the parts of")
+		return
+	}
+
+	folder := g_ui.folderSelected
+	uid := g_ui.previewUid
+	updateStatusBar(fmt.Sprintf(
+		"Downloading structure of email id: %d from %s", uid, folder))
+	go func() {
+		structure, err := fetchEmailStructure(folder, uid)
+		g_ui.app.QueueUpdateDraw(func() {
+			if err != nil {
+				updateStatusBar(fmt.Sprintf(
+					"Unable to download structure of email id %d: %v",
+					uid, err))
+				return
+			}
+			if g_ui.mode != UIModeNormal {
+				return
+			}
+			g_ui.mimeFolder = folder
+			g_ui.mimeUid = uid
+			root := mimeTreeRoot(structure)
+			g_ui.mimeTree.SetRoot(root).SetCurrentNode(root)
+			g_ui.mimeTree.SetTitle(fmt.Sprintf("Parts of \"%s\"",
+				cachedEmailFromUid(folder, uid).subject))
+			g_ui.mimePartText.SetText("").SetTitle("Part")
+			setUIMode(UIModeMimeTree)
+			updateStatusBar(fmt.Sprintf(
+				"Downloaded structure of email id: %d", uid))
+		})
+	}()
+}
+
+func mimeTreeSelectedPart() *MimePart {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	node := g_ui.mimeTree.GetCurrentNode()
+	if node == nil {
+		return nil
+	}
+	return node.GetReference().(*MimePart)
+}
+
+// downloads the part in the background, then is called back on the ui
+// thread with it
+func mimeTreeFetchPart(part *MimePart, then func(data []byte)) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := g_ui.mimeFolder
+	uid := g_ui.mimeUid
+	updateStatusBar(fmt.Sprintf("Downloading part %s of email id: %d",
+		part.name(), uid))
+	go func() {
+		data, err := fetchEmailPart(folder, uid, part)
+		g_ui.app.QueueUpdateDraw(func() {
+			if err != nil {
+				updateStatusBar(fmt.Sprintf(
+					"Unable to download part %s: %v", part.name(), err))
+				return
+			}
+			updateStatusBar(fmt.Sprintf("Downloaded part %s, size of %s",
+				part.name(), FormatHumanReadableSize(int64(len(data)))))
+			then(data)
+		})
+	}()
+}
+
+func mimeTreeShowPart(node *tview.TreeNode) {
+	part := node.GetReference().(*MimePart)
+	mimeTreeFetchPart(part, func(data []byte) {
+		g_ui.mimePartText.
+			SetText(mimePartText(part, data)).
+			ScrollToBeginning().
+			SetTitle("Part " + part.name())
+	})
+}
+
+func mimeTreeSaveSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	part := mimeTreeSelectedPart()
+	if part == nil {
+		return
+	}
+	filename := part.filename()
+	showPrompt("Save part to:", filename, func(text string) {
+		path := strings.TrimSpace(text)
+		if path == "" {
+			path = filename
+		}
+		path = expandHomeDir(path)
+		mimeTreeFetchPart(part, func(data []byte) {
+			// not overwriting, in case it was picked by mistake
+			file, err := os.OpenFile(path,
+				os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+			if err == nil {
+				_, err = file.Write(data)
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			if err != nil {
+				updateStatusBar(fmt.Sprintf("Unable to save part %s: %v",
+					part.name(), err))
+				return
+			}
+			updateStatusBar(fmt.Sprintf("Saved part %s to %s",
+				part.name(), path))
+		})
+	})
+}
+
+// runs a shell command with the part as its input, and shows what it printed
+// in place of the part
+func mimeTreePipeSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	part := mimeTreeSelectedPart()
+	if part == nil {
+		return
+	}
+	showPrompt("Pipe part to:", "e.g. file -, openssl asn1parse -inform der",
+		func(command string) {
+			if strings.TrimSpace(command) == "" {
+				return
+			}
+			mimeTreeFetchPart(part, func(data []byte) {
+				go func() {
+					cmd := exec.Command("sh", "-c", command)
+					cmd.Stdin = bytes.NewReader(data)
+					output, err := cmd.CombinedOutput()
+					g_ui.app.QueueUpdateDraw(func() {
+						if err != nil {
+							updateStatusBar(fmt.Sprintf(
+								"Piping part %s to \"%s\" failed: %v",
+								part.name(), command, err))
+						}
+						g_ui.mimePartText.
+							SetText(decodeAsUTF8(string(output))).
+							ScrollToBeginning().
+							SetTitle(fmt.Sprintf("Part %s | %s",
+								part.name(), command))
+					})
+				}()
+			})
+		})
+}
@@ -6,21 +6,67 @@ import (
 	"sync"
 	"time"
 	"unsafe"
+
+	"github.com/emersion/go-imap"
 )
 
 type Email struct {
-	uid         uint32
-	seqNum      uint32
-	folder      string
-	subject     string
-	date        time.Time
-	toAddress   string
-	ccAddress   string
+	uid       uint32
+	seqNum    uint32
+	folder    string
+	messageId string
+	subject   string
+	date      time.Time
+	// when the server received it
+	arrival   time.Time
+	toAddress string
+	ccAddress string
+	// only known for emails we're sending, it's not in the headers we send
+	bccAddress  string
 	fromAddress string
 	fromName    string
 	body        string
 	size        uint64
-	isRead      bool
+	// bytes downloaded for the body, less than size when only the text part
+	// was downloaded
+	sizeDownloaded uint64
+	isRead         bool
+	isFlagged      bool
+	// kept once the body is known, even when the body is evicted
+	hasAttachments bool
+	// whether it was unread or flagged when the folder was last sorted, so
+	// sorting them first doesn't move emails as they're read or flagged
+	sortedUnread  bool
+	sortedFlagged bool
+	attachments   []Attachment
+	// when a composed email is scheduled to be sent, zero for right away
+	sendAt time.Time
+	// body is markdown, sent as plain text with an html alternative
+	markdown bool
+	// sent as pgp/mime
+	pgpSign    bool
+	pgpEncrypt bool
+	// sent with an s/mime signature
+	smimeSign bool
+	// pgp or s/mime verification and decryption of a received email, for
+	// the preview
+	security string
+	// html the body was rendered from, kept until html_filter renders it
+	// again when the email is shown
+	bodyHTML string
+}
+
+// an attachment either points at a local file picked in compose, or carries
+// the decoded contents of a part from a downloaded email (for forwarding)
+type Attachment struct {
+	filename    string
+	contentType string
+	size        int64
+	path        string
+	data        []byte
+	// the part of a downloaded email that data comes from, while it's still
+	// on the server
+	part *MimePart
 }
 
 var (
@@ -32,6 +78,8 @@ var (
 func modelInit() {
 	g_emailFromUid = make(map[string]map[uint32]*Email)
 	g_emailsFromFolder = make(map[string][]*Email)
+	bodyCacheInit()
+	emailSortInit()
 }
 
 func cachedEmailFromUidsBinarySearch(emailsUidList []uint32, email Email) int {
@@ -42,17 +90,10 @@ func cachedEmailFromUidsBinarySearch(emailsUidList []uint32, email Email) int {
 	assertValidFolderName(folder)
 	return sort.Search(len(emailsUidList), func(k int) bool {
 		e := g_emailFromUid[folder][emailsUidList[k]]
-		return !emailCompare(e, &email)
+		return !emailCompareLocked(e, &email)
 	})
 }
 
-func emailCompare(e1 *Email, e2 *Email) bool {
-	if e1.date == e2.date {
-		return e1.uid > e2.uid
-	}
-	return e1.date.After(e2.date)
-}
-
 func cachedEmailByFolderBinarySearchLocked(email Email) int {
 	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
 	Require(email.uid != 0, "email.id required")
@@ -61,7 +102,7 @@ func cachedEmailByFolderBinarySearchLocked(email Email) int {
 	folder := email.folder
 	assertValidFolderName(folder)
 	return sort.Search(len(g_emailsFromFolder[folder]), func(k int) bool {
-		return !emailCompare(g_emailsFromFolder[folder][k], &email)
+		return !emailCompareLocked(g_emailsFromFolder[folder][k], &email)
 	})
 }
 
@@ -89,7 +130,8 @@ func cachedEmailByFolderInsertLocked(email *Email) (int, bool) {
 	return i, false
 }
 
-func cachedEmailRemoveViaSeqNum(folder string, seqNum uint32) int {
+// returns the uid of the email removed, 0 when there was none
+func cachedEmailRemoveViaSeqNum(folder string, seqNum uint32) uint32 {
 	g_emailsMu.Lock()
 	defer g_emailsMu.Unlock()
 
@@ -114,31 +156,141 @@ func cachedEmailRemoveViaSeqNum(folder string, seqNum uint32) int {
 		g_emailsFromFolder[folder][iToRemove+1:]...)
 
 	if iToRemove != -1 {
+		bodyCacheRemoveLocked(BodyCacheKey{folder, uidToRemove})
 		n := len(g_emailFromUid[folder])
 		delete(g_emailFromUid[folder], uidToRemove)
 		Assert(n > len(g_emailFromUid[folder]), "emailFromUid not removed")
 	}
 
-	return iToRemove
+	return uidToRemove
+}
+
+// for removing emails we moved away ourselves, which unlike expunges we hear
+// about through idle, are identified by uid
+func cachedEmailRemoveViaUid(folder string, uid uint32) bool {
+	g_emailsMu.Lock()
+	email, ok := g_emailFromUid[folder][uid]
+	g_emailsMu.Unlock()
+	if !ok {
+		return false
+	}
+	return cachedEmailRemoveViaSeqNum(folder, email.seqNum) != 0
 }
 
 func cachedEmailBodyUpdate(
 	folder string,
 	uid uint32,
 	body string,
+	attachments []Attachment,
 	size int64,
+	sizeDownloaded int64,
 	isRead bool,
+	security string,
 ) {
 	Require(body != "", "we need some body to update")
 	assertValidFolderName(folder)
 	g_emailsMu.Lock()
 	email, ok := g_emailFromUid[folder][uid]
 	Assert(ok, "we needed a valid envelope first before setting body")
-	email.isRead = isRead
+	// a peek that raced with the email being viewed doesn't make it unread
+	email.isRead = email.isRead || isRead
 	email.body = body
+	email.bodyHTML = ""
+	email.attachments = attachments
+	email.hasAttachments = len(attachments) > 0
 	email.size = uint64(size)
+	email.sizeDownloaded = uint64(sizeDownloaded)
+	email.security = security
 	assertEmailCorrectlyInCacheLocked(folder, email)
+	evicted := bodyCacheAddLocked(email)
+	g_emailsMu.Unlock()
+	bodyCacheSpill(evicted)
+}
+
+// puts back a body that was evicted to disk, false when the email is gone
+func cachedEmailBodyRestore(
+	folder string, uid uint32, entry BodyCacheEntry, attachments []Attachment,
+) bool {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	email, ok := g_emailFromUid[folder][uid]
+	if !ok {
+		g_emailsMu.Unlock()
+		return false
+	}
+	email.body = entry.Body
+	email.bodyHTML = entry.BodyHTML
+	email.security = entry.Security
+	email.sizeDownloaded = entry.SizeDownloaded
+	email.attachments = attachments
+	evicted := bodyCacheAddLocked(email)
+	g_emailsMu.Unlock()
+	bodyCacheSpill(evicted)
+	return true
+}
+
+func cachedEmailBodyHTMLSet(folder string, uid uint32, bodyHTML string) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	email, ok := g_emailFromUid[folder][uid]
+	if !ok || email.body == "" {
+		g_emailsMu.Unlock()
+		return
+	}
+	email.bodyHTML = bodyHTML
+	evicted := bodyCacheAddLocked(email)
+	g_emailsMu.Unlock()
+	bodyCacheSpill(evicted)
+}
+
+// replaces the builtin rendering of an html body with what html_filter made
+// of it, an empty body keeps the builtin one
+func cachedEmailBodyFiltered(folder string, uid uint32, body string) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	email, ok := g_emailFromUid[folder][uid]
+	if !ok || email.bodyHTML == "" {
+		g_emailsMu.Unlock()
+		return
+	}
+	if body != "" {
+		email.body = body
+	}
+	email.bodyHTML = ""
+	evicted := bodyCacheAddLocked(email)
 	g_emailsMu.Unlock()
+	bodyCacheSpill(evicted)
+}
+
+func cachedEmailBodyTouch(folder string, uid uint32) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	bodyCacheTouchLocked(BodyCacheKey{folder, uid})
+}
+
+func cachedEmailSetRead(folder string, uid uint32) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	if email, ok := g_emailFromUid[folder][uid]; ok {
+		email.isRead = true
+	}
+}
+
+func cachedEmailSetFlag(folder string, uid uint32, flag string, on bool) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	email, ok := g_emailFromUid[folder][uid]
+	if !ok {
+		return
+	}
+	if flag == imap.SeenFlag {
+		email.isRead = on
+	} else if flag == imap.FlaggedFlag {
+		email.isFlagged = on
+	}
 }
 
 func cachedEmailFromUid(folder string, uid uint32) Email {
@@ -180,6 +332,26 @@ func cachedEmailEnvelopeSet(email *Email) {
 	g_emailsMu.Unlock()
 }
 
+func cachedEmailFolderClear(folder string) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	bodyCacheRemoveFolderLocked(folder)
+	delete(g_emailFromUid, folder)
+	delete(g_emailsFromFolder, folder)
+}
+
+func cachedEmailsFromFolder(folder string) []Email {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	emails := make([]Email, 0, len(g_emailsFromFolder[folder]))
+	for _, email := range g_emailsFromFolder[folder] {
+		emails = append(emails, *email)
+	}
+	return emails
+}
+
 func cachedEmailFromFolderItemCount(folder string) int {
 	assertValidFolderName(folder)
 	g_emailsMu.Lock()
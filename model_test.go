@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCachedEmailBodyUpdateKeepsRead(t *testing.T) {
+	testModelInit(t)
+	cachedEmailEnvelopeSet(&Email{uid: 1, seqNum: 1, folder: "Inbox"})
+
+	// viewed, then a prefetch that peeked before it was seen finishes
+	cachedEmailBodyUpdate("Inbox", 1, "body", nil, 4, 4, true, "")
+	cachedEmailBodyUpdate("Inbox", 1, "body", nil, 4, 4, false, "")
+	if !cachedEmailFromUid("Inbox", 1).isRead {
+		t.Errorf("a body downloaded by peeking made a read email unread")
+	}
+}
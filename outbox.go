@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the outbox isn't on the server, its folder can't be the name of one
+	// there, e.g. the Outbox Exchange creates, as imap names can't have NUL
+	outboxFolder          = "\x00Outbox"
+	outboxFolderTitle     = "Outbox"
+	outboxRetryBackoffMin = 30 * time.Second
+	outboxRetryBackoffMax = time.Hour
+)
+
+type OutboxAttachment struct {
+	Filename    string
+	ContentType string
+	Path        string `json:",omitempty"`
+	Data        []byte `json:",omitempty"`
+}
+
+// persisted as json in the outbox directory, one file per queued email, so
+// nothing is lost when sending fails or kagimail exits before it is sent
+type OutboxEntry struct {
+	Id          uint32
+	QueuedAt    time.Time
+	FromAddress string
+	FromName    string
+	ToAddress   string
+	CcAddress   string
+	BccAddress  string `json:",omitempty"`
+	Subject     string
+	Body        string
+	Markdown    bool               `json:",omitempty"`
+	PGPSign     bool               `json:",omitempty"`
+	PGPEncrypt  bool               `json:",omitempty"`
+	SMIMESign   bool               `json:",omitempty"`
+	Attachments []OutboxAttachment `json:",omitempty"`
+
+	// when the email was scheduled to be sent, zero for sending right away
+	ScheduledFor time.Time
+
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+	// permanent failures are kept until they're edited and sent again, or
+	// cancelled
+	Failed bool `json:",omitempty"`
+	// open in compose, it's not sent meanwhile. Not persisted, an edit
+	// doesn't outlive kagimail so neither does holding the entry for it
+	Editing bool `json:"-"`
+}
+
+// whether the smtp worker should leave the entry alone
+func (entry *OutboxEntry) held() bool {
+	return entry.Failed || entry.Editing
+}
+
+var (
+	g_outboxMu     sync.Mutex
+	g_outbox       map[uint32]*OutboxEntry
+	g_outboxIdNext uint32
+	// entry the smtp worker is sending right now, it can't be edited
+	g_outboxSendingId uint32
+)
+
+func outboxDir() string {
+	dir := dataFilePath("outbox")
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		log.Printf("unable to create outbox directory: %v", err)
+	}
+	return dir
+}
+
+func outboxEntryPath(id uint32) string {
+	return filepath.Join(outboxDir(), fmt.Sprintf("%d.json", id))
+}
+
+func outboxLoad() {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+
+	g_outbox = make(map[uint32]*OutboxEntry)
+	g_outboxIdNext = 1
+	files, err := os.ReadDir(outboxDir())
+	if err != nil {
+		log.Printf("unable to read outbox: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(outboxDir(), file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("unable to read outbox entry \"%s\": %v", path, err)
+			continue
+		}
+		var entry OutboxEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil || entry.Id == 0 {
+			log.Printf("unable to parse outbox entry \"%s\": %v", path, err)
+			continue
+		}
+		g_outbox[entry.Id] = &entry
+		g_outboxIdNext = max(g_outboxIdNext, entry.Id+1)
+	}
+}
+
+func outboxSaveLocked(entry *OutboxEntry) error {
+	Assert(g_outboxMu.TryLock() == false, "g_outboxMu needs to be locked")
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(outboxEntryPath(entry.Id), data)
+}
+
+func outboxDeleteLocked(id uint32) {
+	Assert(g_outboxMu.TryLock() == false, "g_outboxMu needs to be locked")
+	delete(g_outbox, id)
+	err := os.Remove(outboxEntryPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove outbox entry %d: %v", id, err)
+	}
+}
+
+func outboxEnqueue(email Email, sendAt time.Time) (uint32, error) {
+	g_outboxMu.Lock()
+	entry := outboxEntryFromEmail(email)
+	entry.Id = g_outboxIdNext
+	entry.QueuedAt = time.Now()
+	entry.NextAttempt = sendAt
+	err := outboxSaveLocked(&entry)
+	if err == nil {
+		g_outboxIdNext++
+		g_outbox[entry.Id] = &entry
+	}
+	g_outboxMu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	outboxNotifyChanged()
+	return entry.Id, nil
+}
+
+// entries ready to go out now, oldest first
+func outboxDue(now time.Time) []OutboxEntry {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+
+	var entries []OutboxEntry
+	for _, entry := range g_outbox {
+		if !entry.held() && !entry.NextAttempt.After(now) {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.Before(entries[j].QueuedAt)
+	})
+	return entries
+}
+
+// earliest time an entry that isn't held is ready to be sent, zero if none
+func outboxNextAttempt() time.Time {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+
+	var next time.Time
+	for _, entry := range g_outbox {
+		if entry.held() {
+			continue
+		}
+		if next.IsZero() || entry.NextAttempt.Before(next) {
+			next = entry.NextAttempt
+		}
+	}
+	return next
+}
+
+// claims the entry for sending, fails if it was edited or cancelled since
+func outboxBeginSend(id uint32) bool {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+	entry, ok := g_outbox[id]
+	if !ok || entry.held() {
+		return false
+	}
+	g_outboxSendingId = id
+	return true
+}
+
+func outboxFinishSend(id uint32, err error, transient bool) {
+	g_outboxMu.Lock()
+	g_outboxSendingId = 0
+	entry, ok := g_outbox[id]
+	Assert(ok, "outbox entry removed while sending")
+	if err == nil {
+		outboxDeleteLocked(id)
+	} else {
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if transient {
+			backoff := outboxRetryBackoffMin << min(entry.Attempts-1, 16)
+			entry.NextAttempt = time.Now().Add(
+				min(backoff, outboxRetryBackoffMax))
+		} else {
+			entry.Failed = true
+		}
+		saveErr := outboxSaveLocked(entry)
+		if saveErr != nil {
+			log.Printf("unable to save outbox entry %d: %v", id, saveErr)
+		}
+	}
+	g_outboxMu.Unlock()
+	outboxNotifyChanged()
+}
+
+// holds an entry so it won't be sent while it's being edited in compose
+func outboxHold(id uint32) (OutboxEntry, bool) {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+	entry, ok := g_outbox[id]
+	if !ok || g_outboxSendingId == id {
+		return OutboxEntry{}, false
+	}
+	entry.Editing = true
+	return *entry, true
+}
+
+// puts an entry held for editing back as it was, failed ones stay failed and
+// scheduled ones keep their time, the rest are retried right away
+func outboxRelease(id uint32) {
+	g_outboxMu.Lock()
+	entry, ok := g_outbox[id]
+	if ok {
+		entry.Editing = false
+		if !entry.Failed && entry.ScheduledFor.IsZero() {
+			entry.NextAttempt = time.Now()
+			err := outboxSaveLocked(entry)
+			if err != nil {
+				log.Printf("unable to save outbox entry %d: %v", id, err)
+			}
+		}
+	}
+	g_outboxMu.Unlock()
+	outboxNotifyChanged()
+	smtpWake()
+}
+
+func outboxCancel(id uint32) bool {
+	g_outboxMu.Lock()
+	_, ok := g_outbox[id]
+	ok = ok && g_outboxSendingId != id
+	if ok {
+		outboxDeleteLocked(id)
+	}
+	g_outboxMu.Unlock()
+	if ok {
+		outboxNotifyChanged()
+	}
+	return ok
+}
+
+func outboxEntries() []OutboxEntry {
+	g_outboxMu.Lock()
+	defer g_outboxMu.Unlock()
+	var entries []OutboxEntry
+	for _, entry := range g_outbox {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+func outboxEntryFromEmail(email Email) OutboxEntry {
+	entry := OutboxEntry{
+		FromAddress:  email.fromAddress,
+		FromName:     email.fromName,
+		ToAddress:    email.toAddress,
+		CcAddress:    email.ccAddress,
+		BccAddress:   email.bccAddress,
+		Subject:      email.subject,
+		Body:         email.body,
+		Markdown:     email.markdown,
+		PGPSign:      email.pgpSign,
+		PGPEncrypt:   email.pgpEncrypt,
+		SMIMESign:    email.smimeSign,
+		ScheduledFor: email.sendAt,
+	}
+	for _, attachment := range email.attachments {
+		entry.Attachments = append(entry.Attachments, OutboxAttachment{
+			Filename:    attachment.filename,
+			ContentType: attachment.contentType,
+			Path:        attachment.path,
+			Data:        attachment.data,
+		})
+	}
+	return entry
+}
+
+func emailFromOutboxEntry(entry OutboxEntry) Email {
+	email := Email{
+		uid:         entry.Id,
+		folder:      outboxFolder,
+		subject:     entry.Subject,
+		date:        entry.QueuedAt,
+		toAddress:   entry.ToAddress,
+		ccAddress:   entry.CcAddress,
+		bccAddress:  entry.BccAddress,
+		fromAddress: entry.FromAddress,
+		fromName:    entry.FromName,
+		body:        entry.Body,
+		markdown:    entry.Markdown,
+		pgpSign:     entry.PGPSign,
+		pgpEncrypt:  entry.PGPEncrypt,
+		smimeSign:   entry.SMIMESign,
+		isRead:      true,
+		sendAt:      entry.ScheduledFor,
+	}
+	for _, attachment := range entry.Attachments {
+		size := int64(len(attachment.Data))
+		if attachment.Data == nil {
+			info, err := os.Stat(attachment.Path)
+			if err == nil {
+				size = info.Size()
+			}
+		}
+		email.attachments = append(email.attachments, Attachment{
+			filename:    attachment.Filename,
+			contentType: attachment.ContentType,
+			size:        size,
+			path:        attachment.Path,
+			data:        attachment.Data,
+		})
+	}
+	return email
+}
+
+// how an entry is listed in the Outbox virtual folder: recipient in the from
+// column, delivery status ahead of the subject and above the body
+func emailFromOutboxEntryForList(entry OutboxEntry) Email {
+	email := emailFromOutboxEntry(entry)
+	email.fromName = "To: " + entry.ToAddress
+
+	status := "queued"
+	if entry.Attempts == 0 && time.Now().Before(entry.NextAttempt) {
+		status = fmt.Sprintf("sending in %ds",
+			int(time.Until(entry.NextAttempt).Seconds()))
+		if !entry.ScheduledFor.IsZero() {
+			status = "scheduled " + entry.ScheduledFor.Format("2 Jan 15:04")
+		}
+	}
+	if entry.Editing {
+		status = "editing"
+	} else if entry.Failed {
+		status = "failed"
+	} else if entry.Attempts > 0 {
+		status = fmt.Sprintf("retry %d", entry.Attempts)
+	}
+	email.subject = fmt.Sprintf("(%s) %s", status, entry.Subject)
+
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("Queued: %s\n", FormatLocalizedTime(entry.QueuedAt)))
+	if !entry.ScheduledFor.IsZero() {
+		body.WriteString(fmt.Sprintf("Scheduled for: %s\n",
+			FormatLocalizedTime(entry.ScheduledFor)))
+	}
+	if entry.LastError != "" {
+		body.WriteString(fmt.Sprintf("Attempts: %d\nLast error: %s\n",
+			entry.Attempts, entry.LastError))
+	}
+	if !entry.held() && entry.Attempts > 0 {
+		body.WriteString(fmt.Sprintf("Next attempt: %s\n",
+			FormatLocalizedTime(entry.NextAttempt)))
+	}
+	body.WriteString("\n" + entry.Body)
+	email.body = body.String()
+	return email
+}
+
+func outboxNotifyChanged() {
+	g_ui.app.QueueUpdateDraw(func() {
+		if g_ui.folderSelected == outboxFolder {
+			outboxFolderShow()
+		}
+	})
+}
+
+// fills the emails table from the outbox rather than an imap folder
+func outboxFolderShow() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderDownloadCancel != nil {
+		g_ui.folderDownloadCancel()
+	}
+
+	if g_ui.folderSelected != outboxFolder {
+		g_ui.folderSelected = outboxFolder
+		g_ui.markedUids = make(map[uint32]bool)
+		filterReset()
+		g_ui.previewUid = 0
+		g_ui.previewText.SetTitle("Preview")
+		g_ui.previewText.SetText("", false)
+		setHintsBarText()
+	}
+
+	cachedEmailFolderClear(outboxFolder)
+	for _, entry := range outboxEntries() {
+		email := emailFromOutboxEntryForList(entry)
+		cachedEmailEnvelopeSet(&email)
+	}
+
+	rowSelected, _ := g_ui.emailsTable.GetSelection()
+	g_ui.emailsTable.Clear()
+	g_ui.emailsUidList = g_ui.emailsUidList[:0]
+	for row, email := range cachedEmailsFromFolder(outboxFolder) {
+		g_ui.emailsUidList = append(g_ui.emailsUidList, email.uid)
+		updateImapEmailInTable(row, email)
+	}
+	g_ui.emailsUidListAll = append(g_ui.emailsUidListAll[:0],
+		g_ui.emailsUidList...)
+	g_ui.folderItemCount = len(g_ui.emailsUidList)
+	if g_ui.folderItemCount > 0 {
+		g_ui.emailsTable.Select(min(rowSelected, g_ui.folderItemCount-1), 0)
+	}
+	updateEmailStatusBarWithSelection()
+}
+
+func outboxEditSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if len(g_ui.emailsUidList) == 0 {
+		return
+	}
+	row, _ := g_ui.emailsTable.GetSelection()
+	entry, ok := outboxHold(g_ui.emailsUidList[row])
+	if !ok {
+		updateStatusBar("Email is being sent right now, can't edit it")
+		return
+	}
+	outboxNotifyChanged()
+
+	composeSetEmail(emailFromOutboxEntry(entry))
+	g_ui.composeOutboxId = entry.Id
+}
+
+func outboxCancelSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if len(g_ui.emailsUidList) == 0 {
+		return
+	}
+	row, _ := g_ui.emailsTable.GetSelection()
+	email := cachedEmailFromUid(outboxFolder, g_ui.emailsUidList[row])
+	if !outboxCancel(email.uid) {
+		updateStatusBar("Email is being sent right now, can't cancel it")
+		return
+	}
+	updateStatusBar(fmt.Sprintf("Cancelled sending email to: %s",
+		email.toAddress))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+func testOutboxInit(t *testing.T) {
+	t.Helper()
+	testModelInit(t)
+	// outbox changes are queued for the ui, which runs on a screen that's
+	// only in memory
+	screen := tcell.NewSimulationScreen("")
+	g_ui.app = tview.NewApplication().SetScreen(screen).
+		SetRoot(tview.NewBox(), true)
+	go func() {
+		_ = g_ui.app.Run()
+	}()
+	t.Cleanup(g_ui.app.Stop)
+	outboxLoad()
+}
+
+func TestOutboxEditingIsNotPersisted(t *testing.T) {
+	testOutboxInit(t)
+	id, err := outboxEnqueue(Email{toAddress: "bob@example.com"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := outboxHold(id); !ok {
+		t.Fatalf("outboxHold failed")
+	}
+	if len(outboxDue(time.Now())) != 0 {
+		t.Errorf("an email being edited is due to be sent")
+	}
+
+	// kagimail quit while it was being edited
+	outboxLoad()
+	if len(outboxDue(time.Now())) != 1 {
+		t.Errorf("an email that was being edited is held after a restart")
+	}
+}
+
+func TestOutboxReleaseKeepsFailed(t *testing.T) {
+	testOutboxInit(t)
+	id, err := outboxEnqueue(Email{toAddress: "bob@example.com"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !outboxBeginSend(id) {
+		t.Fatalf("outboxBeginSend failed")
+	}
+	outboxFinishSend(id, errors.New("550 no such user"), false)
+
+	if _, ok := outboxHold(id); !ok {
+		t.Fatalf("outboxHold failed")
+	}
+	// escaped out of compose without sending the edit
+	outboxRelease(id)
+	if len(outboxDue(time.Now())) != 0 {
+		t.Errorf("a failed email was queued again by leaving the edit")
+	}
+	entries := outboxEntries()
+	if len(entries) != 1 || !entries[0].Failed || entries[0].Editing {
+		t.Errorf("entries %+v, want one that failed", entries)
+	}
+
+	outboxLoad()
+	entries = outboxEntries()
+	if len(entries) != 1 || !entries[0].Failed {
+		t.Errorf("entries %+v after a restart, want one that failed", entries)
+	}
+}
+
+func TestOutboxReleaseKeepsSchedule(t *testing.T) {
+	testOutboxInit(t)
+	sendAt := time.Now().Add(time.Hour)
+	id, err := outboxEnqueue(Email{toAddress: "bob@example.com",
+		sendAt: sendAt}, sendAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := outboxHold(id); !ok {
+		t.Fatalf("outboxHold failed")
+	}
+	outboxRelease(id)
+	if len(outboxDue(time.Now())) != 0 {
+		t.Errorf("a scheduled email is due right after leaving its edit")
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	netmail "net/mail"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-message/textproto"
+)
+
+// when compose ticks encrypt, "auto" does so once every recipient has a key
+// in the public keyring
+const (
+	pgpEncryptNever  = "never"
+	pgpEncryptAlways = "always"
+	pgpEncryptAuto   = "auto"
+)
+
+// the security status of emails we decrypted starts with this, those bodies
+// are kept off disk
+const pgpStatusDecrypted = "PGP: decrypted"
+
+var (
+	g_pgpOnce    sync.Once
+	g_pgpPublic  openpgp.EntityList
+	g_pgpSecret  openpgp.EntityList
+	g_pgpLoadErr error
+)
+
+func pgpConfigured() bool {
+	return g_config.PGPPublicKeyring != "" || g_config.PGPSecretKeyring != ""
+}
+
+func pgpReadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(expandHomeDir(path))
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		// not armored, try it as a binary keyring
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	return keyring, err
+}
+
+// keyrings are read the first time they're needed, secret keys are unlocked
+// with pgp_passphrase up front since we've no way to prompt mid-send
+func pgpKeyrings() (public, secret openpgp.EntityList, err error) {
+	g_pgpOnce.Do(func() {
+		if !pgpConfigured() {
+			g_pgpLoadErr = errors.New("no pgp keyrings in kagimail.toml")
+			return
+		}
+		if g_config.PGPPublicKeyring != "" {
+			g_pgpPublic, g_pgpLoadErr = pgpReadKeyring(g_config.PGPPublicKeyring)
+			if g_pgpLoadErr != nil {
+				g_pgpLoadErr = fmt.Errorf("unable to read public keyring: %v",
+					g_pgpLoadErr)
+				return
+			}
+		}
+		if g_config.PGPSecretKeyring != "" {
+			g_pgpSecret, g_pgpLoadErr = pgpReadKeyring(g_config.PGPSecretKeyring)
+			if g_pgpLoadErr != nil {
+				g_pgpLoadErr = fmt.Errorf("unable to read secret keyring: %v",
+					g_pgpLoadErr)
+				return
+			}
+			passphrase := []byte(g_config.PGPPassphrase)
+			for _, entity := range g_pgpSecret {
+				err := entity.DecryptPrivateKeys(passphrase)
+				if err != nil {
+					g_pgpLoadErr = fmt.Errorf("unable to unlock secret key: %v",
+						err)
+					return
+				}
+			}
+		}
+	})
+	return g_pgpPublic, g_pgpSecret, g_pgpLoadErr
+}
+
+// public and secret keys together, for verifying and decrypting
+func pgpKeyringAll() (openpgp.EntityList, error) {
+	public, secret, err := pgpKeyrings()
+	if err != nil {
+		return nil, err
+	}
+	all := append(openpgp.EntityList{}, secret...)
+	return append(all, public...), nil
+}
+
+func pgpEntityHasAddress(entity *openpgp.Entity, address string) bool {
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil &&
+			strings.EqualFold(identity.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func pgpEntityForAddress(
+	keyring openpgp.EntityList, address string,
+) *openpgp.Entity {
+	for _, entity := range keyring {
+		if pgpEntityHasAddress(entity, address) {
+			return entity
+		}
+	}
+	return nil
+}
+
+// a good signature only vouches for the sender when the key is theirs,
+// anyone's key would otherwise do for any from address
+func pgpSignatureStatus(signer *openpgp.Entity, from string) string {
+	if !pgpEntityHasAddress(signer, from) {
+		return fmt.Sprintf("signature from %s doesn't match sender %s",
+			pgpEntityName(signer), from)
+	}
+	return "verified signature from " + pgpEntityName(signer)
+}
+
+func pgpEntityName(entity *openpgp.Entity) string {
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		return identity.Name
+	}
+	return fmt.Sprintf("%X", entity.PrimaryKey.KeyId)
+}
+
+// recipients that we have no public key for, so can't encrypt to
+func pgpMissingKeys(addresses []string) []string {
+	public, secret, err := pgpKeyrings()
+	if err != nil {
+		return addresses
+	}
+	var missing []string
+	for _, address := range addresses {
+		if pgpEntityForAddress(public, address) == nil &&
+			pgpEntityForAddress(secret, address) == nil {
+			missing = append(missing, address)
+		}
+	}
+	return missing
+}
+
+// wraps a rendered message in rfc 3156 pgp/mime, signed as
+// multipart/signed, encrypted (and maybe signed) as multipart/encrypted.
+// Encrypted emails are also encrypted to our own key so the copy in Sent
+// can be read
+func pgpWrapMessage(
+	raw []byte, from string, recipients []string, sign bool, encrypt bool,
+) ([]byte, error) {
+	public, secret, err := pgpKeyrings()
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *openpgp.Entity
+	if sign {
+		signer = pgpEntityForAddress(secret, from)
+		if signer == nil {
+			return nil, fmt.Errorf("no secret key to sign as %s", from)
+		}
+	}
+
+	header, entity, err := mimeSplitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	entity = mimeCanonicalize(entity)
+
+	boundary := mimeBoundary()
+	var body bytes.Buffer
+	if encrypt {
+		var to []*openpgp.Entity
+		for _, address := range append(recipients, from) {
+			key := pgpEntityForAddress(public, address)
+			if key == nil {
+				key = pgpEntityForAddress(secret, address)
+			}
+			if key == nil {
+				return nil, fmt.Errorf("no public key for %s", address)
+			}
+			to = append(to, key)
+		}
+
+		var armored bytes.Buffer
+		armorWriter, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := openpgp.Encrypt(armorWriter, to, signer, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt: %v", err)
+		}
+		_, err = plaintext.Write(entity)
+		if err == nil {
+			err = plaintext.Close()
+		}
+		if err == nil {
+			err = armorWriter.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt: %v", err)
+		}
+
+		header.Set("Content-Type", mime.FormatMediaType("multipart/encrypted",
+			map[string]string{
+				"protocol": "application/pgp-encrypted",
+				"boundary": boundary,
+			}))
+		fmt.Fprintf(&body, "--%s\r\n", boundary)
+		body.WriteString("Content-Type: application/pgp-encrypted\r\n")
+		body.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+		body.WriteString("Version: 1\r\n\r\n")
+		fmt.Fprintf(&body, "--%s\r\n", boundary)
+		body.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+		body.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+		body.Write(mimeCanonicalize(armored.Bytes()))
+		fmt.Fprintf(&body, "\r\n--%s--\r\n", boundary)
+	} else {
+		var signature bytes.Buffer
+		err := openpgp.ArmoredDetachSign(
+			&signature, signer, bytes.NewReader(entity), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign: %v", err)
+		}
+
+		header.Set("Content-Type", mime.FormatMediaType("multipart/signed",
+			map[string]string{
+				"micalg":   "pgp-sha256",
+				"protocol": "application/pgp-signature",
+				"boundary": boundary,
+			}))
+		body.Write(mimeSignedBody(entity, boundary,
+			"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n"+
+				"Content-Description: OpenPGP digital signature\r\n",
+			signature.Bytes()))
+	}
+
+	var wrapped bytes.Buffer
+	err = textproto.WriteHeader(&wrapped, header)
+	if err != nil {
+		return nil, err
+	}
+	wrapped.Write(body.Bytes())
+	return wrapped.Bytes(), nil
+}
+
+func pgpVerifySigned(
+	raw []byte, body []byte, boundary string, from string,
+) string {
+	signed, err := mimeFirstPart(body, boundary)
+	if err != nil {
+		return fmt.Sprintf("PGP: can't verify, %v", err)
+	}
+	signature, err := mimePartBody(raw, 1)
+	if err != nil {
+		return fmt.Sprintf("PGP: can't verify, %v", err)
+	}
+	keyring, err := pgpKeyringAll()
+	if err != nil {
+		return fmt.Sprintf("PGP: can't verify, %v", err)
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring,
+		bytes.NewReader(mimeCanonicalize(signed)),
+		bytes.NewReader(signature), nil)
+	if err != nil {
+		return fmt.Sprintf("PGP: bad signature, %v", err)
+	}
+	return "PGP: " + pgpSignatureStatus(signer, from)
+}
+
+// decrypts a multipart/encrypted message, the decrypted entity takes the
+// place of the encrypted one under the outer headers
+func pgpDecrypt(raw []byte, header textproto.Header) ([]byte, string, error) {
+	ciphertext, err := mimePartBody(raw, 1)
+	if err != nil {
+		return nil, "", err
+	}
+	keyring, err := pgpKeyringAll()
+	if err != nil {
+		return nil, "", err
+	}
+
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, "", err
+	}
+	details, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err := io.ReadAll(details.UnverifiedBody)
+	if err != nil {
+		return nil, "", err
+	}
+
+	status := pgpStatusDecrypted
+	if details.IsSigned {
+		switch {
+		case details.SignedBy == nil:
+			status += fmt.Sprintf(", signed by unknown key %X",
+				details.SignedByKeyId)
+		case details.SignatureError != nil:
+			status += fmt.Sprintf(", bad signature, %v",
+				details.SignatureError)
+		default:
+			status += ", " + pgpSignatureStatus(details.SignedBy.Entity,
+				mimeFromAddress(header))
+		}
+	}
+
+	decrypted, err := mimeReplaceEntity(header, plaintext)
+	if err != nil {
+		return nil, "", err
+	}
+	return decrypted, status, nil
+}
+
+// verifies and decrypts pgp/mime emails, returning the message to show and
+// a status for the preview title, empty for emails without pgp
+func pgpProcessMessage(raw []byte) ([]byte, string) {
+	reader := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(reader)
+	if err != nil {
+		return raw, ""
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return raw, ""
+	}
+	protocol := strings.ToLower(params["protocol"])
+
+	switch {
+	case mediaType == "multipart/signed" &&
+		protocol == "application/pgp-signature":
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return raw, fmt.Sprintf("PGP: can't verify, %v", err)
+		}
+		return raw, pgpVerifySigned(raw, body, params["boundary"],
+			mimeFromAddress(header))
+
+	case mediaType == "multipart/encrypted" &&
+		protocol == "application/pgp-encrypted":
+		decrypted, status, err := pgpDecrypt(raw, header)
+		if err != nil {
+			return raw, fmt.Sprintf("PGP: can't decrypt, %v", err)
+		}
+		// signed then encrypted as separate layers
+		decrypted, innerStatus := pgpProcessMessage(decrypted)
+		if innerStatus != "" {
+			status += ", " + strings.TrimPrefix(innerStatus, "PGP: ")
+		}
+		return decrypted, status
+	}
+	return raw, ""
+}
+
+// catches what would fail to sign or encrypt before the email is queued
+func composeCheckPGP(
+	email Email, addresses map[string][]*netmail.Address,
+) error {
+	if !email.pgpSign && !email.pgpEncrypt {
+		return nil
+	}
+	_, secret, err := pgpKeyrings()
+	if err != nil {
+		return err
+	}
+	if email.pgpSign && pgpEntityForAddress(secret, email.fromAddress) == nil {
+		return fmt.Errorf("no secret key to sign as %s", email.fromAddress)
+	}
+	if email.pgpEncrypt && len(addresses[composeLabelBcc]) > 0 {
+		return errors.New(
+			"can't encrypt to bcc recipients, the others would see their keys")
+	}
+	if email.pgpEncrypt {
+		missing := pgpMissingKeys(
+			append(composeRecipients(addresses), email.fromAddress))
+		if len(missing) > 0 {
+			return fmt.Errorf("can't encrypt, no public key for %s",
+				strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+func composeRecipients(addresses map[string][]*netmail.Address) []string {
+	var recipients []string
+	for _, label := range composeAddressLabels {
+		for _, address := range addresses[label] {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return recipients
+}
+
+// with pgp_encrypt = "auto", encrypt is ticked as long as we have a key for
+// everyone the email is going to and none of them are bcc'd, until it's
+// ticked or unticked by hand
+func composeApplyEncryptPolicy() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_config.PGPEncrypt != pgpEncryptAuto || g_ui.composeEncryptTouched {
+		return
+	}
+	addresses, _, err := composeAddressesFromForm()
+	if err != nil {
+		return
+	}
+	recipients := composeRecipients(addresses)
+	composeCheckbox(composeLabelEncrypt).SetChecked(
+		len(recipients) > 0 && len(addresses[composeLabelBcc]) == 0 &&
+			len(pgpMissingKeys(recipients)) == 0)
+	// that wasn't by hand
+	g_ui.composeEncryptTouched = false
+}
+
+func onComposeEncryptChanged(_ bool) {
+	g_ui.composeEncryptTouched = true
+}
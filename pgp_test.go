@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// writes keyrings of freshly generated keys to a temporary directory, alice
+// is us with her secret key, bob and carol only have public keys
+func testPGPInit(t *testing.T) {
+	t.Helper()
+	testModelInit(t)
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+	var public, secret bytes.Buffer
+	for _, name := range []string{"alice", "bob", "carol"} {
+		entity, err := openpgp.NewEntity(
+			strings.ToUpper(name[:1])+name[1:], "", name+"@example.com",
+			config)
+		if err != nil {
+			t.Fatalf("unable to generate key for %s: %v", name, err)
+		}
+		if name == "alice" {
+			err = entity.SerializePrivate(&secret, config)
+		} else {
+			err = entity.Serialize(&public)
+		}
+		if err != nil {
+			t.Fatalf("unable to serialize key for %s: %v", name, err)
+		}
+	}
+
+	dir := t.TempDir()
+	g_config.PGPPublicKeyring = filepath.Join(dir, "public.gpg")
+	g_config.PGPSecretKeyring = filepath.Join(dir, "secret.gpg")
+	for path, data := range map[string][]byte{
+		g_config.PGPPublicKeyring: public.Bytes(),
+		g_config.PGPSecretKeyring: secret.Bytes(),
+	} {
+		err := os.WriteFile(path, data, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g_pgpOnce = sync.Once{}
+}
+
+// renders the email as it would be sent, then reads it back the way a
+// downloaded email is
+func testPGPRoundTrip(t *testing.T, email Email) (string, string) {
+	t.Helper()
+	msg, err := smtpMessageFromEmail(email)
+	if err != nil {
+		t.Fatalf("smtpMessageFromEmail: %v", err)
+	}
+	raw, _, err := smtpRender(email, msg)
+	if err != nil {
+		t.Fatalf("smtpRender: %v", err)
+	}
+	if email.pgpEncrypt && bytes.Contains(raw, []byte("secret plans")) {
+		t.Fatalf("encrypted email has the body in the clear")
+	}
+
+	processed, security := pgpProcessMessage(raw)
+	body, _, _, err := emailBodyFromRaw(processed)
+	if err != nil {
+		t.Fatalf("emailBodyFromRaw: %v", err)
+	}
+	return body, security
+}
+
+func TestPGPSignVerify(t *testing.T) {
+	testPGPInit(t)
+	email := Email{fromAddress: "alice@example.com",
+		toAddress: "bob@example.com", subject: "hi", body: "secret plans",
+		pgpSign: true}
+
+	body, security := testPGPRoundTrip(t, email)
+	if !strings.Contains(body, "secret plans") {
+		t.Errorf("signed body %q, want the text", body)
+	}
+	if security != "PGP: verified signature from Alice <alice@example.com>" {
+		t.Errorf("signed status %q, want verified from Alice", security)
+	}
+}
+
+func TestPGPSignatureFromAnotherSender(t *testing.T) {
+	testPGPInit(t)
+	email := Email{fromAddress: "alice@example.com",
+		toAddress: "bob@example.com", subject: "hi", body: "secret plans",
+		pgpSign: true}
+	msg, err := smtpMessageFromEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := smtpRender(email, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a good signature by alice on an email claiming to be from carol
+	forged := bytes.Replace(raw, []byte("From: alice@example.com"),
+		[]byte("From: carol@example.com"), 1)
+	if bytes.Equal(forged, raw) {
+		t.Fatalf("no from header to replace in %q", raw)
+	}
+	_, security := pgpProcessMessage(forged)
+	if strings.Contains(security, "verified") ||
+		!strings.Contains(security, "doesn't match sender carol@example.com") {
+		t.Errorf("forged status %q, want a sender mismatch", security)
+	}
+}
+
+func TestPGPEncryptDecrypt(t *testing.T) {
+	testPGPInit(t)
+	email := Email{fromAddress: "alice@example.com",
+		toAddress: "bob@example.com", ccAddress: "carol@example.com",
+		subject: "hi", body: "secret plans", pgpSign: true, pgpEncrypt: true}
+
+	// encrypted to alice too, so we can read it back
+	body, security := testPGPRoundTrip(t, email)
+	if !strings.Contains(body, "secret plans") {
+		t.Errorf("decrypted body %q, want the text", body)
+	}
+	want := pgpStatusDecrypted +
+		", verified signature from Alice <alice@example.com>"
+	if security != want {
+		t.Errorf("decrypted status %q, want %q", security, want)
+	}
+}
+
+func TestPGPEncryptRefusesBcc(t *testing.T) {
+	testPGPInit(t)
+	email := Email{fromAddress: "alice@example.com",
+		toAddress: "bob@example.com", bccAddress: "carol@example.com",
+		subject: "hi", body: "secret plans", pgpEncrypt: true}
+	msg, err := smtpMessageFromEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = smtpRender(email, msg)
+	if err == nil {
+		t.Errorf("encrypting with bcc recipients didn't fail")
+	}
+}
+
+func TestPGPMissingKeys(t *testing.T) {
+	testPGPInit(t)
+	missing := pgpMissingKeys([]string{
+		"alice@example.com", "BOB@example.com", "dave@example.com",
+	})
+	if len(missing) != 1 || missing[0] != "dave@example.com" {
+		t.Errorf("pgpMissingKeys = %v, want [dave@example.com]", missing)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	prefetchNearbyDefault   = 5
+	prefetchUnreadDefault   = 50
+	prefetchBudgetMBDefault = 10
+)
+
+// bodies to download in the background, in the order given, the latest
+// request replaces any that weren't done yet
+type PrefetchRequest struct {
+	folder string
+	uids   []uint32
+}
+
+var chPrefetch chan PrefetchRequest
+
+// queues the emails around the selected row, closest first, followed by the
+// most recent unread emails. The selected email is the body worker's to
+// download, it's often the most recent unread one too
+func prefetchAround(row int) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := g_ui.folderSelected
+	if folder == outboxFolder || len(g_ui.emailsUidList) == 0 {
+		return
+	}
+
+	var uids []uint32
+	queued := map[uint32]bool{g_ui.previewUid: true}
+	if row >= 0 && row < len(g_ui.emailsUidList) {
+		queued[g_ui.emailsUidList[row]] = true
+	}
+	queue := func(uid uint32) {
+		if !queued[uid] {
+			queued[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	for i := 1; i <= g_config.PrefetchNearby; i++ {
+		if row+i < len(g_ui.emailsUidList) {
+			queue(g_ui.emailsUidList[row+i])
+		}
+		if row-i >= 0 {
+			queue(g_ui.emailsUidList[row-i])
+		}
+	}
+	unread := 0
+	for _, uid := range g_ui.emailsUidList {
+		if unread == g_config.PrefetchUnread {
+			break
+		}
+		if !cachedEmailFromUid(folder, uid).isRead {
+			queue(uid)
+			unread++
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+
+	select {
+	case chPrefetch <- PrefetchRequest{folder, uids}:
+	default:
+		// the worker drains to the latest request anyway
+	}
+}
+
+// runs on its own connection so the body worker for the selected email is
+// never stuck behind it, and peeks so prefetched emails stay unread until
+// they are viewed
+func prefetchWorker() {
+	clt := imapLogin()
+	defer clt.Logout()
+
+	var req PrefetchRequest
+	for {
+		if req.folder == "" {
+			req = <-chPrefetch
+		}
+		// only the latest request matters, the cursor has moved on
+		for len(chPrefetch) > 0 {
+			req = <-chPrefetch
+		}
+		req = prefetchRun(clt, req)
+	}
+}
+
+// downloads bodies until the budget is spent, or returns early with a newer
+// request as soon as one comes in
+func prefetchRun(clt *client.Client, req PrefetchRequest) PrefetchRequest {
+	_, err := clt.Select(req.folder, true /* readOnly */)
+	if err != nil {
+		log.Printf("unable to prefetch from %s: %v", req.folder, err)
+		return PrefetchRequest{}
+	}
+
+	budget := int64(g_config.PrefetchBudgetMB) << 20
+	for _, uid := range req.uids {
+		select {
+		case newer := <-chPrefetch:
+			return newer
+		default:
+		}
+
+		if budget <= 0 {
+			break
+		}
+		email, ok := cachedEmailFromUidChecked(req.folder, uid)
+		if !ok || email.body != "" {
+			continue
+		}
+
+		trace("prefetch body for: %d", uid)
+		err := prefetchBody(clt, req.folder, uid)
+		if err != nil {
+			log.Printf("unable to prefetch email %d from %s: %v",
+				uid, req.folder, err)
+			continue
+		}
+		email, ok = cachedEmailFromUidChecked(req.folder, uid)
+		if ok {
+			budget -= int64(email.sizeDownloaded)
+		}
+	}
+	return PrefetchRequest{}
+}
+
+func prefetchBody(clt *client.Client, folder string, uid uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	chEmails := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- clt.UidFetch(seqSet, []imap.FetchItem{
+			imap.FetchUid, imap.FetchFlags,
+			imap.FetchBodyStructure, imap.FetchRFC822Size,
+		}, chEmails)
+	}()
+	var imapEmails []*imap.Message
+	for imapEmail := range chEmails {
+		imapEmails = append(imapEmails, imapEmail)
+	}
+	err := <-done
+	if err != nil {
+		return err
+	}
+
+	for _, imapEmail := range imapEmails {
+		err = updateEmailBody(clt, folder, imapEmail, true /* peek */)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefetched emails were peeked at, so they're marked read once viewed
+func emailMarkRead(folder string, uid uint32) {
+	err := imapCommand(folder, func(clt *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		return clt.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true),
+			[]interface{}{imap.SeenFlag}, nil)
+	})
+	if err != nil {
+		updateStatusBar(fmt.Sprintf(
+			"Unable to mark email id %d as read: %v", uid, err))
+		return
+	}
+
+	cachedEmailSetRead(folder, uid)
+	g_ui.app.QueueUpdateDraw(func() {
+		if g_ui.folderSelected != folder {
+			return
+		}
+		for row, rowUid := range g_ui.emailsUidList {
+			if rowUid == uid {
+				updateImapEmailInTable(row, cachedEmailFromUid(folder, uid))
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rivo/tview"
+)
+
+// quoted text is rewrapped to fit this many columns, prefix included
+const quoteWrapWidth = 72
+
+// how many levels of quoting a line has, and the line without the quote
+// prefix, both ">> text" and "> > text" are two levels
+func quoteDepth(line string) (int, string) {
+	depth := 0
+	rest := line
+	for {
+		trimmed := strings.TrimLeft(rest, " ")
+		if !strings.HasPrefix(trimmed, ">") {
+			break
+		}
+		// a leading space before the first ">" is just indented text
+		if depth == 0 && trimmed != rest {
+			break
+		}
+		depth++
+		rest = trimmed[1:]
+	}
+	if depth > 0 {
+		rest = strings.TrimPrefix(rest, " ")
+	}
+	return depth, rest
+}
+
+func quotePrefix(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return strings.Repeat(">", depth) + " "
+}
+
+// reflows quoted paragraphs of text to width, a paragraph being consecutive
+// lines of the same quote depth, and a short line ends one since it was most
+// likely broken on purpose. Unquoted text, indented lines that look
+// preformatted, and the signature are left alone. A width of 0 joins
+// paragraphs into one line each, for format=flowed to wrap when sending
+func rewrapQuoted(text string, width int) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	var words []string
+	paragraphDepth := 0
+
+	flush := func() {
+		if len(words) == 0 {
+			return
+		}
+		prefix := quotePrefix(paragraphDepth)
+		line := prefix
+		for _, word := range words {
+			if line != prefix && width > 0 && len(line)+1+len(word) > width {
+				out = append(out, line)
+				line = prefix
+			}
+			if line != prefix {
+				line += " "
+			}
+			line += word
+		}
+		out = append(out, line)
+		words = nil
+	}
+
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if line == signatureDelimiter {
+			flush()
+			out = append(out, lines[i:]...)
+			break
+		}
+
+		depth, rest := quoteDepth(line)
+		if depth != paragraphDepth {
+			flush()
+			paragraphDepth = depth
+		}
+		if depth == 0 || strings.TrimSpace(rest) == "" ||
+			strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "\t") {
+			flush()
+			out = append(out, strings.TrimRight(line, " "))
+			continue
+		}
+		words = append(words, strings.Fields(rest)...)
+		if len(rest) < quoteWrapWidth/2 {
+			flush()
+		}
+	}
+	flush()
+	return strings.Join(out, "\n")
+}
+
+// quotes text one level deeper, rewrapping it to fit the quote prefix
+func quoteText(text string) string {
+	var quoted []string
+	for _, line := range strings.Split(text, "\n") {
+		depth, rest := quoteDepth(strings.TrimRight(line, "\r"))
+		if strings.TrimSpace(rest) == "" {
+			quoted = append(quoted, strings.TrimRight(quotePrefix(depth+1), " "))
+			continue
+		}
+		quoted = append(quoted, quotePrefix(depth+1)+rest)
+	}
+	return rewrapQuoted(strings.Join(quoted, "\n"), quoteWrapWidth)
+}
+
+// builds an interleaved reply, the original is quoted paragraph by
+// paragraph so comments can be written between them, and the signature
+// goes at the bottom like the rest of the reply
+func inlineReplyText(
+	attribution string, original string, identity Identity,
+) string {
+	var reply strings.Builder
+	reply.WriteString(attribution + "\n")
+	paragraphs := strings.Split(strings.Trim(original, "\n"), "\n\n")
+	for i, paragraph := range paragraphs {
+		paragraph = strings.Trim(paragraph, "\n")
+		if paragraph == "" {
+			continue
+		}
+		if i > 0 {
+			reply.WriteString("\n")
+		}
+		reply.WriteString(quoteText(paragraph) + "\n")
+	}
+	if signatureBlock := identity.signatureBlock(); signatureBlock != "" {
+		reply.WriteString("\n" + signatureBlock)
+	}
+	return reply.String()
+}
+
+// breaks the quoted line under the cursor in two, leaving an empty line
+// between the halves to comment on the first half. Returns false when the
+// cursor isn't on a quoted line
+func inlineReplySplitAtCursor(textArea *tview.TextArea) bool {
+	text := textArea.GetText()
+	_, cursor, _ := textArea.GetSelection()
+	lineStart := strings.LastIndex(text[:cursor], "\n") + 1
+	lineEnd := len(text)
+	if i := strings.Index(text[cursor:], "\n"); i != -1 {
+		lineEnd = cursor + i
+	}
+
+	depth, _ := quoteDepth(text[lineStart:lineEnd])
+	if depth == 0 {
+		return false
+	}
+
+	rest := strings.TrimLeft(text[cursor:lineEnd], " ")
+	insert := "\n\n\n"
+	if rest != "" {
+		insert += "\n" + quotePrefix(depth)
+	}
+	textArea.Replace(cursor, lineEnd, insert+rest)
+	textArea.Select(cursor+2, cursor+2)
+	return true
+}
+
+// a quoted paragraph, consecutive quoted lines of one depth, with the lines
+// it's on. Its text is its words without the spaces between them, so it
+// compares the same however it's wrapped or where it was split
+type quoteBlock struct {
+	depth      int
+	text       string
+	start, end int
+}
+
+func quoteBlocks(lines []string) []quoteBlock {
+	var blocks []quoteBlock
+	for i, line := range lines {
+		depth, rest := quoteDepth(strings.TrimRight(line, "\r"))
+		words := strings.Fields(rest)
+		if depth == 0 || len(words) == 0 {
+			continue
+		}
+		n := len(blocks)
+		if n > 0 && blocks[n-1].end == i && blocks[n-1].depth == depth {
+			blocks[n-1].text += strings.Join(words, "")
+			blocks[n-1].end = i + 1
+			continue
+		}
+		blocks = append(blocks, quoteBlock{
+			depth: depth, text: strings.Join(words, ""), start: i, end: i + 1,
+		})
+	}
+	return blocks
+}
+
+// drops quoted paragraphs after the last comment, as long as they are still
+// as they were quoted, a reply without any comments is left alone
+func inlineReplyTrimTrailingQuotes(body string, quoted string) string {
+	original := make(map[string]bool)
+	for _, line := range strings.Split(quoted, "\n") {
+		original[strings.TrimRight(line, " ")] = true
+	}
+	originalBlocks := make(map[quoteBlock]bool)
+	for _, block := range quoteBlocks(strings.Split(quoted, "\n")) {
+		originalBlocks[quoteBlock{depth: block.depth, text: block.text}] = true
+	}
+
+	signature := ""
+	if i := strings.Index(body, signatureDelimiter+"\n"); i != -1 &&
+		(i == 0 || body[i-1] == '\n') {
+		body, signature = body[:i], body[i:]
+	}
+
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	blocks := quoteBlocks(lines)
+	// a whole quoted paragraph, or the last half of one that was split with
+	// the halves before it still above
+	isOriginalQuote := func(k int) bool {
+		block := quoteBlock{depth: blocks[k].depth, text: blocks[k].text}
+		if originalBlocks[block] {
+			return true
+		}
+		for j := k - 1; j >= 0; j-- {
+			if blocks[j].depth != block.depth {
+				continue
+			}
+			block.text = blocks[j].text + block.text
+			if originalBlocks[block] {
+				return true
+			}
+		}
+		return false
+	}
+
+	end := len(lines)
+	k := len(blocks) - 1
+	for end > 0 {
+		depth, rest := quoteDepth(strings.TrimRight(lines[end-1], " "))
+		if strings.TrimSpace(rest) == "" {
+			end--
+			continue
+		}
+		if depth == 0 || k < 0 || blocks[k].end != end || !isOriginalQuote(k) {
+			break
+		}
+		end = blocks[k].start
+		k--
+	}
+
+	commented := false
+	for _, line := range lines[:end] {
+		depth, rest := quoteDepth(line)
+		if depth == 0 && strings.TrimSpace(rest) != "" &&
+			!original[strings.TrimRight(line, " ")] {
+			commented = true
+			break
+		}
+	}
+	if !commented {
+		end = len(lines)
+	}
+
+	trimmed := strings.Join(lines[:end], "\n") + "\n"
+	if signature != "" {
+		trimmed += "\n" + signature
+	}
+	return trimmed
+}
+
+// what's sent for an inline reply, trailing quotes trimmed and quoted
+// paragraphs joined back up, they're wrapped again as format=flowed when
+// sending so recipients can reflow them
+func inlineReplyPrepare(body string, quoted string) string {
+	return rewrapQuoted(inlineReplyTrimTrailingQuotes(body, quoted), 0)
+}
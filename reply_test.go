@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rivo/tview"
+)
+
+func TestRewrapQuoted(t *testing.T) {
+	long := strings.Repeat("word ", 20)
+	tests := []struct {
+		name  string
+		text  string
+		width int
+		want  string
+	}{
+		{"quoted paragraphs are joined and wrapped",
+			"> " + long + "\n> " + long + "\n>\n> short",
+			30,
+			strings.Repeat("> word word word word word\n", 8) + ">\n> short"},
+		{"short lines end a paragraph", "> one\n> two", 72, "> one\n> two"},
+		{"depths are wrapped separately",
+			">> " + long + "\n> " + long,
+			40,
+			">> word word word word word word word\n" +
+				">> word word word word word word word\n" +
+				">> word word word word word word\n" +
+				"> word word word word word word word\n" +
+				"> word word word word word word word\n" +
+				"> word word word word word word"},
+		{"unquoted, indented and signature lines are left alone",
+			"reply   \n>     code  here\n-- \n> not quoted",
+			72, "reply\n>     code  here\n-- \n> not quoted"},
+		{"width 0 joins paragraphs into one line",
+			"> " + long + "\n> " + long, 0,
+			"> " + strings.TrimSpace(strings.Repeat("word ", 40))},
+	}
+	for _, test := range tests {
+		if got := rewrapQuoted(test.text, test.width); got != test.want {
+			t.Errorf("%s: rewrapQuoted = %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestInlineReplySplitAtCursor(t *testing.T) {
+	tests := []struct {
+		text   string
+		cursor int
+		ok     bool
+		want   string
+	}{
+		{"> first half second half\n> next", len("> first half"), true,
+			"> first half\n\n\n\n> second half\n> next"},
+		{"> at the end\nreply", len("> at the end"), true,
+			"> at the end\n\n\n\nreply"},
+		{">> deeper quote", len(">> deeper"), true,
+			">> deeper\n\n\n\n>> quote"},
+		{"not quoted", 3, false, "not quoted"},
+	}
+	for _, test := range tests {
+		textArea := tview.NewTextArea()
+		textArea.SetText(test.text, false)
+		textArea.Select(test.cursor, test.cursor)
+		ok := inlineReplySplitAtCursor(textArea)
+		if got := textArea.GetText(); ok != test.ok || got != test.want {
+			t.Errorf("inlineReplySplitAtCursor(%q, %d) = %q, %v, want %q, %v",
+				test.text, test.cursor, got, ok, test.want, test.ok)
+		}
+		if _, cursor, _ := textArea.GetSelection(); ok &&
+			cursor != test.cursor+2 {
+			t.Errorf("cursor at %d after splitting %q, want %d", cursor,
+				test.text, test.cursor+2)
+		}
+	}
+}
+
+func TestInlineReplyTrimTrailingQuotes(t *testing.T) {
+	quoted := "On Monday Bob wrote:\n" +
+		"> first paragraph of the\n> original\n\n" +
+		"> second paragraph\n\n" +
+		"> third\n\n" +
+		"-- \nAlice\n"
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no comments leaves it alone", quoted, quoted},
+		{"unedited quotes after the last comment are dropped",
+			"On Monday Bob wrote:\n" +
+				"> first paragraph of the\n> original\n\nyes\n\n" +
+				"> second paragraph\n\n> third\n\n-- \nAlice\n",
+			"On Monday Bob wrote:\n" +
+				"> first paragraph of the\n> original\n\nyes\n\n-- \nAlice\n"},
+		{"an edited quote is kept",
+			"On Monday Bob wrote:\n> first paragraph of the\n> original\n\n" +
+				"yes\n\n> second\n\n-- \nAlice\n",
+			"On Monday Bob wrote:\n> first paragraph of the\n> original\n\n" +
+				"yes\n\n> second\n\n-- \nAlice\n"},
+		{"the last half of a split paragraph is dropped",
+			"On Monday Bob wrote:\n> first paragraph\n\n\nagreed\n\n" +
+				"> of the\n> original\n\n> second paragraph\n\n> third\n",
+			"On Monday Bob wrote:\n> first paragraph\n\n\nagreed\n"},
+		{"a short edited quote within the original is kept",
+			"On Monday Bob wrote:\n> first paragraph of the\n> original\n\n" +
+				"yes\n\n> paragraph\n",
+			"On Monday Bob wrote:\n> first paragraph of the\n> original\n\n" +
+				"yes\n\n> paragraph\n"},
+	}
+	for _, test := range tests {
+		got := inlineReplyTrimTrailingQuotes(test.body, quoted)
+		if got != test.want {
+			t.Errorf("%s: inlineReplyTrimTrailingQuotes = %q, want %q",
+				test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"go.mozilla.org/pkcs7"
+)
+
+// like pgpStatusDecrypted
+const smimeStatusDecrypted = "S/MIME: decrypted"
+
+var (
+	g_smimeOnce    sync.Once
+	g_smimeRoots   *x509.CertPool
+	g_smimeCerts   []*x509.Certificate
+	g_smimeKey     crypto.PrivateKey
+	g_smimeLoadErr error
+)
+
+func smimeReadPEM(path string) ([]*pem.Block, error) {
+	data, err := os.ReadFile(expandHomeDir(path))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("no pem blocks in %s", path)
+	}
+	return blocks, nil
+}
+
+func smimeParseKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+// the ca bundle is what signatures are trusted against, the system roots
+// when there is none. Our certificate, with its chain after it, and key are
+// only needed for signing
+func smimeLoad() (*x509.CertPool, error) {
+	g_smimeOnce.Do(func() {
+		if g_config.SMIMECABundle == "" {
+			g_smimeRoots, g_smimeLoadErr = x509.SystemCertPool()
+		} else {
+			g_smimeRoots = x509.NewCertPool()
+			blocks, err := smimeReadPEM(g_config.SMIMECABundle)
+			for _, block := range blocks {
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err == nil {
+					g_smimeRoots.AddCert(cert)
+				}
+			}
+			g_smimeLoadErr = err
+		}
+		if g_smimeLoadErr != nil {
+			g_smimeLoadErr = fmt.Errorf("unable to read ca bundle: %v",
+				g_smimeLoadErr)
+			return
+		}
+
+		if g_config.SMIMECertificate != "" {
+			blocks, err := smimeReadPEM(g_config.SMIMECertificate)
+			for _, block := range blocks {
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					g_smimeLoadErr = fmt.Errorf(
+						"unable to read certificate: %v", err)
+					return
+				}
+				g_smimeCerts = append(g_smimeCerts, cert)
+			}
+			if err != nil {
+				g_smimeLoadErr = fmt.Errorf(
+					"unable to read certificate: %v", err)
+				return
+			}
+		}
+		if g_config.SMIMEKey != "" {
+			blocks, err := smimeReadPEM(g_config.SMIMEKey)
+			if err == nil {
+				g_smimeKey, err = smimeParseKey(blocks[0].Bytes)
+			}
+			if err != nil {
+				g_smimeLoadErr = fmt.Errorf("unable to read key: %v", err)
+				return
+			}
+		}
+	})
+	return g_smimeRoots, g_smimeLoadErr
+}
+
+// our certificate and key, when both are configured
+func smimeSigner() (*x509.Certificate, []*x509.Certificate, crypto.PrivateKey,
+	error) {
+	_, err := smimeLoad()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(g_smimeCerts) == 0 || g_smimeKey == nil {
+		return nil, nil, nil, errors.New(
+			"smime_certificate and smime_key need to be in kagimail.toml")
+	}
+	return g_smimeCerts[0], g_smimeCerts[1:], g_smimeKey, nil
+}
+
+func smimeCertName(cert *x509.Certificate) string {
+	name := cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		if name == "" {
+			return cert.EmailAddresses[0]
+		}
+		name += " <" + cert.EmailAddresses[0] + ">"
+	}
+	return name
+}
+
+func smimeCertHasAddress(cert *x509.Certificate, address string) bool {
+	for _, certAddress := range cert.EmailAddresses {
+		if strings.EqualFold(certAddress, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// wraps a rendered message as an rfc 8551 multipart/signed with a detached
+// signature, so clients without s/mime still show the content
+func smimeSignMessage(raw []byte) ([]byte, error) {
+	cert, chain, key, err := smimeSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	header, entity, err := mimeSplitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	entity = mimeCanonicalize(entity)
+
+	signedData, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign: %v", err)
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	err = signedData.AddSignerChain(cert, key, chain, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign: %v", err)
+	}
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign: %v", err)
+	}
+
+	var encoded strings.Builder
+	b64 := base64.StdEncoding.EncodeToString(signature)
+	for len(b64) > 76 {
+		encoded.WriteString(b64[:76] + "\r\n")
+		b64 = b64[76:]
+	}
+	encoded.WriteString(b64)
+
+	boundary := mimeBoundary()
+	header.Set("Content-Type", mime.FormatMediaType("multipart/signed",
+		map[string]string{
+			"micalg":   "sha-256",
+			"protocol": "application/pkcs7-signature",
+			"boundary": boundary,
+		}))
+	body := mimeSignedBody(entity, boundary,
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n",
+		[]byte(encoded.String()))
+
+	var signed bytes.Buffer
+	err = textproto.WriteHeader(&signed, header)
+	if err != nil {
+		return nil, err
+	}
+	signed.Write(body)
+	return signed.Bytes(), nil
+}
+
+// checks the signature itself, then that the signer chains up to the ca
+// bundle and is the sender, p7.Content needs to be set to what was signed
+func smimeVerify(p7 *pkcs7.PKCS7, from string) string {
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return "S/MIME: can't verify, no single signer"
+	}
+	name := smimeCertName(signer)
+
+	err := p7.Verify()
+	if err != nil {
+		// digest mismatches go on to list both digests on more lines
+		reason, _, _ := strings.Cut(err.Error(), "\n")
+		return fmt.Sprintf("S/MIME: bad signature from %s, %s", name, reason)
+	}
+	roots, err := smimeLoad()
+	if err != nil {
+		return fmt.Sprintf("S/MIME: can't verify %s, %v", name, err)
+	}
+	err = p7.VerifyWithChain(roots)
+	if err != nil {
+		return fmt.Sprintf("S/MIME: untrusted signature from %s, %v",
+			name, err)
+	}
+	if !smimeCertHasAddress(signer, from) {
+		return fmt.Sprintf("S/MIME: signature from %s doesn't match sender %s",
+			name, from)
+	}
+	return "S/MIME: verified signature from " + name
+}
+
+// verifies s/mime signed emails, and unwraps opaque signed and encrypted
+// ones, returning the message to show and a status for the preview title,
+// empty for emails without s/mime
+func smimeProcessMessage(raw []byte) ([]byte, string) {
+	reader := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(reader)
+	if err != nil {
+		return raw, ""
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return raw, ""
+	}
+	protocol := strings.ToLower(params["protocol"])
+
+	switch {
+	case mediaType == "multipart/signed" &&
+		(protocol == "application/pkcs7-signature" ||
+			protocol == "application/x-pkcs7-signature"):
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't verify, %v", err)
+		}
+		signed, err := mimeFirstPart(body, params["boundary"])
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't verify, %v", err)
+		}
+		signature, err := mimePartBody(raw, 1)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't verify, %v", err)
+		}
+		p7, err := pkcs7.Parse(signature)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't verify, %v", err)
+		}
+		p7.Content = mimeCanonicalize(signed)
+		return raw, smimeVerify(p7, mimeFromAddress(header))
+
+	case mediaType == "application/pkcs7-mime" ||
+		mediaType == "application/x-pkcs7-mime":
+		entity, err := message.Read(bytes.NewReader(raw))
+		if err != nil && !isUnknownCharsetOrEncoding(err) {
+			return raw, fmt.Sprintf("S/MIME: can't read, %v", err)
+		}
+		der, err := io.ReadAll(entity.Body)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't read, %v", err)
+		}
+		p7, err := pkcs7.Parse(der)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't read, %v", err)
+		}
+
+		var content []byte
+		var status string
+		if len(p7.Signers) > 0 {
+			content, status = p7.Content,
+				smimeVerify(p7, mimeFromAddress(header))
+		} else {
+			cert, _, key, err := smimeSigner()
+			if err == nil {
+				content, err = p7.Decrypt(cert, key)
+			}
+			if err != nil {
+				return raw, fmt.Sprintf("S/MIME: can't decrypt, %v", err)
+			}
+			status = smimeStatusDecrypted
+		}
+
+		unwrapped, err := mimeReplaceEntity(header, content)
+		if err != nil {
+			return raw, fmt.Sprintf("S/MIME: can't read, %v", err)
+		}
+		// usually signed inside of encrypted
+		unwrapped, innerStatus := smimeProcessMessage(unwrapped)
+		if innerStatus != "" {
+			status += ", " + strings.TrimPrefix(innerStatus, "S/MIME: ")
+		}
+		return unwrapped, status
+	}
+	return raw, ""
+}
+
+// catches what would fail to sign before the email is queued
+func composeCheckSMIME(email Email) error {
+	if !email.smimeSign {
+		return nil
+	}
+	if email.pgpSign || email.pgpEncrypt {
+		return errors.New("can't use both pgp and s/mime on one email")
+	}
+	cert, _, _, err := smimeSigner()
+	if err != nil {
+		return err
+	}
+	if !smimeCertHasAddress(cert, email.fromAddress) {
+		return fmt.Errorf("s/mime certificate is for %s, not %s",
+			smimeCertName(cert), email.fromAddress)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a self signed certificate for alice, that's also the whole ca bundle
+func testSMIMEInit(t *testing.T) {
+	t.Helper()
+	testModelInit(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Alice"},
+		EmailAddresses:        []string{"alice@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	g_config.SMIMECABundle = filepath.Join(dir, "ca.pem")
+	g_config.SMIMECertificate = g_config.SMIMECABundle
+	g_config.SMIMEKey = filepath.Join(dir, "key.pem")
+	for path, block := range map[string]*pem.Block{
+		g_config.SMIMECABundle: {Type: "CERTIFICATE", Bytes: der},
+		g_config.SMIMEKey:      {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	g_smimeOnce = sync.Once{}
+	g_smimeCerts = nil
+	g_smimeKey = nil
+}
+
+func TestSMIMESignVerify(t *testing.T) {
+	testSMIMEInit(t)
+	email := Email{fromAddress: "alice@example.com",
+		toAddress: "bob@example.com", subject: "hi", body: "signed text",
+		smimeSign: true}
+	msg, err := smtpMessageFromEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := smtpRender(email, msg)
+	if err != nil {
+		t.Fatalf("smtpRender: %v", err)
+	}
+
+	_, security := smimeProcessMessage(raw)
+	want := "S/MIME: verified signature from Alice <alice@example.com>"
+	if security != want {
+		t.Errorf("signed status %q, want %q", security, want)
+	}
+
+	// a good signature by alice on an email claiming to be from carol
+	forged := bytes.Replace(raw, []byte("From: alice@example.com"),
+		[]byte("From: carol@example.com"), 1)
+	if bytes.Equal(forged, raw) {
+		t.Fatalf("no from header to replace in %q", raw)
+	}
+	_, security = smimeProcessMessage(forged)
+	if strings.Contains(security, "verified") ||
+		!strings.Contains(security, "doesn't match sender carol@example.com") {
+		t.Errorf("forged status %q, want a sender mismatch", security)
+	}
+}
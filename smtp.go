@@ -1,58 +1,262 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	netmail "net/mail"
+	"net/textproto"
 	"strings"
 	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
 	"gopkg.in/mail.v2"
 )
 
-var chSendMails chan Email
+const (
+	sendDelaySecondsDefault = 10
+	sentFolderDefault       = "Sent"
+)
+
+var chOutboxWake chan struct{}
 
 func smtpInit() {
-	chSendMails = make(chan Email, 10)
+	chOutboxWake = make(chan struct{}, 1)
+	outboxLoad()
+	showOutboxInFoldersList()
 	go smtpWorker()
 }
 
+func smtpWake() {
+	select {
+	case chOutboxWake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+// drains the outbox, sleeping until the next retry is due or something new
+// is queued
 func smtpWorker() {
 	for {
-		select {
-		case email := <-chSendMails:
-			msg := mail.NewMessage()
-			msg.SetHeader(
-				"From",
-				msg.FormatAddress(email.fromAddress, email.fromName),
-			)
-			msg.SetHeader("To", email.toAddress)
-			if email.ccAddress != "" {
-				msg.SetHeader("Cc", email.ccAddress)
+		for _, entry := range outboxDue(time.Now()) {
+			if !outboxBeginSend(entry.Id) {
+				continue
 			}
-			msg.SetHeader("Subject", email.subject)
-			msg.SetBody("text/plain", email.body)
 
-			dialer := mail.NewDialer(g_config.SMTPHost, 465,
-				g_config.Email, g_config.Password)
-			err := dialer.DialAndSend(msg)
+			email := emailFromOutboxEntry(entry)
+			msg, err := smtpMessageFromEmail(email)
+			var raw []byte
+			var recipients []string
+			if err == nil {
+				raw, recipients, err = smtpRender(email, msg)
+			}
+			transient := false
+			if err == nil {
+				err = smtpSend(email.fromAddress, recipients, raw)
+				transient = smtpIsTransientError(err)
+			}
+			outboxFinishSend(entry.Id, err, transient)
 			if err != nil {
-				updateStatusBar(fmt.Sprintf("Couldn't send email: %v", err))
-				break
+				verb := "will retry"
+				if !transient {
+					verb = "held in Outbox"
+				}
+				updateStatusBar(fmt.Sprintf(
+					"Couldn't send email to: %s, %s: %v",
+					email.toAddress, verb, err))
+				continue
 			}
 
+			contactsHarvestSent(email)
+			smtpSaveToSent(msg, raw)
 			formattedTime := time.Now().Format(time.Stamp)
 			updateStatusBar(fmt.Sprintf(
 				"Email sent to: %s at %s", email.toAddress, formattedTime))
 		}
+
+		wait := time.Hour
+		next := outboxNextAttempt()
+		if !next.IsZero() {
+			wait = max(time.Until(next), time.Second)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-chOutboxWake:
+		case <-timer.C:
+		}
+		timer.Stop()
 	}
 }
 
+func smtpMessageFromEmail(email Email) (*mail.Message, error) {
+	msg := mail.NewMessage()
+	msg.SetHeader(
+		"From",
+		msg.FormatAddress(email.fromAddress, email.fromName),
+	)
+	for _, header := range []struct{ name, field string }{
+		{"To", email.toAddress},
+		{"Cc", email.ccAddress},
+		// gomail leaves bcc out of the headers it writes, but sends to it
+		{"Bcc", email.bccAddress},
+	} {
+		addresses, err := parseAddressList(header.field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", header.name, err)
+		}
+		if len(addresses) == 0 {
+			continue
+		}
+		// FormatAddress encodes non-ascii names as rfc 2047 words
+		var values []string
+		for _, address := range addresses {
+			values = append(values,
+				msg.FormatAddress(address.Address, address.Name))
+		}
+		msg.SetHeader(header.name, values...)
+	}
+	msg.SetHeader("Subject", email.subject)
+	msg.SetBody("text/plain; format=flowed", flowedEncode(email.body))
+	if email.markdown {
+		rendered, err := markdownToHTML(email.body)
+		if err != nil {
+			return nil, err
+		}
+		msg.AddAlternative("text/html", rendered)
+	}
+	for _, attachment := range email.attachments {
+		if attachment.data != nil {
+			var settings []mail.FileSetting
+			if attachment.contentType != "" {
+				settings = append(settings, mail.SetHeader(
+					map[string][]string{
+						"Content-Type": {attachment.contentType},
+					}))
+			}
+			msg.AttachReader(
+				attachment.filename,
+				bytes.NewReader(attachment.data),
+				settings...,
+			)
+		} else {
+			msg.Attach(attachment.path)
+		}
+	}
+	return msg, nil
+}
+
+// renders msg to the bytes that are sent, and saved to Sent so the copy is
+// the same message, along with who it goes to
+func smtpRender(email Email, msg *mail.Message) ([]byte, []string, error) {
+	var raw bytes.Buffer
+	_, err := msg.WriteTo(&raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var recipients []string
+	for _, header := range []string{"To", "Cc", "Bcc"} {
+		for _, value := range msg.GetHeader(header) {
+			address, err := netmail.ParseAddress(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %v", header, err)
+			}
+			recipients = append(recipients, address.Address)
+		}
+	}
+
+	if email.smimeSign {
+		signed, err := smimeSignMessage(raw.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		return signed, recipients, nil
+	}
+	if !email.pgpSign && !email.pgpEncrypt {
+		return raw.Bytes(), recipients, nil
+	}
+	// one message is encrypted to every key, so everyone could tell who was
+	// bcc'd from the key ids
+	if email.pgpEncrypt && len(msg.GetHeader("Bcc")) > 0 {
+		return nil, nil, errors.New("can't encrypt to bcc recipients")
+	}
+	wrapped, err := pgpWrapMessage(raw.Bytes(), email.fromAddress,
+		recipients, email.pgpSign, email.pgpEncrypt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapped, recipients, nil
+}
+
+func smtpSend(from string, recipients []string, raw []byte) error {
+	dialer := mail.NewDialer(g_config.SMTPHost, 465,
+		g_config.Email, g_config.Password)
+	sender, err := dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	return sender.Send(from, recipients, bytes.NewReader(raw))
+}
+
+func sentFolder() string {
+	if g_config.SentFolder != "" {
+		return g_config.SentFolder
+	}
+	return sentFolderDefault
+}
+
+// appends what was sent to the Sent folder, with the bcc header put back in
+// for our own records since it's left out of what recipients get
+func smtpSaveToSent(msg *mail.Message, raw []byte) {
+	if bcc := msg.GetHeader("Bcc"); len(bcc) > 0 {
+		header := "Bcc: " + strings.Join(bcc, ",\r\n ") + "\r\n"
+		raw = append([]byte(header), raw...)
+	}
+
+	err := imapCommand("", func(clt *client.Client) error {
+		return clt.Append(sentFolder(), []string{imap.SeenFlag}, time.Now(),
+			bytes.NewReader(raw))
+	})
+	if err != nil {
+		updateStatusBar(fmt.Sprintf(
+			"Email was sent but couldn't be saved to %s: %v", sentFolder(), err))
+		return
+	}
+	notifyFolderChanged(sentFolder())
+}
+
+// 4xx replies are the server asking us to try again later, and anything that
+// isn't an smtp reply at all is a network problem, so also worth retrying
+func smtpIsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) {
+		err = sendErr.Cause
+	}
+
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) {
+		return replyErr.Code >= 400 && replyErr.Code < 500
+	}
+	return true
+}
+
 func replyEmail(emailOriginal Email, body string) {
 	Require(emailOriginal.uid != 0, "requires id")
 	email_ := emailOriginal
 	email_.body = body
+	identity := identityForReply(emailOriginal)
 	email_.toAddress = emailOriginal.fromAddress
-	email_.fromAddress = g_config.Email
-	email_.fromName = g_config.DisplayName
+	email_.ccAddress = ""
+	email_.attachments = nil
+	email_.fromAddress = identity.Email
+	email_.fromName = identity.DisplayName
 	subject := strings.TrimSpace(email_.subject)
 	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
 		subject = "Re: " + subject
@@ -62,11 +266,54 @@ func replyEmail(emailOriginal Email, body string) {
 }
 
 func composeEmail(email Email) {
-	email.fromAddress = g_config.Email
-	email.fromName = g_config.DisplayName
+	if email.fromAddress == "" {
+		identity := identityDefault()
+		email.fromAddress = identity.Email
+		email.fromName = identity.DisplayName
+	}
 	sendEmail(email)
 }
 
 func sendEmail(email Email) {
-	chSendMails <- email
+	scheduled := !email.sendAt.IsZero()
+	sendAt := email.sendAt
+	if !scheduled {
+		sendAt = time.Now().Add(
+			time.Duration(g_config.SendDelaySeconds) * time.Second)
+	}
+	id, err := outboxEnqueue(email, sendAt)
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Couldn't queue email in Outbox: %v", err))
+		return
+	}
+	smtpWake()
+
+	if scheduled {
+		updateStatusBar(fmt.Sprintf("Scheduled email to: %s for %s",
+			email.toAddress, FormatLocalizedTime(sendAt)))
+	} else if g_config.SendDelaySeconds > 0 {
+		notifyUndoSendStarted(id, email, sendAt)
+	}
+}
+
+// cancels the last sent email if it hasn't gone out yet, and reopens it in
+// compose
+func undoSend() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	id := g_ui.undoSendId
+	g_ui.undoSendId = 0
+	if id == 0 {
+		updateStatusBar("Nothing to undo")
+		return
+	}
+
+	entry, ok := outboxHold(id)
+	if !ok || !outboxCancel(id) {
+		updateStatusBar("Too late to undo, email is already being sent")
+		return
+	}
+
+	email := emailFromOutboxEntry(entry)
+	composeSetEmail(email)
+	updateStatusBar(fmt.Sprintf("Undid sending email to: %s", email.toAddress))
 }
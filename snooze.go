@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	snoozeFolderDefault = "Snoozed"
+	// keywords set on snoozed emails, the fixed one finds them and the one
+	// followed by the unix time they wake up, e.g. $SnoozedUntil-1760950800,
+	// lets restarts and other installs know when
+	snoozeKeyword         = "$Snoozed"
+	snoozeKeywordPrefix   = "$SnoozedUntil-"
+	snoozePollInterval    = time.Minute
+	snoozeRetryBackoffMin = 30 * time.Second
+	snoozeRetryBackoffMax = time.Hour
+)
+
+// persisted in snoozed.json, keyed by message-id, remembers when a snoozed
+// email wakes up. Due emails go back to the inbox, not the folder they were
+// snoozed from, as that's where the request to look at them again belongs
+type SnoozeEntry struct {
+	MessageId string
+	Subject   string
+	WakeAt    time.Time
+	Attempts  int       `json:",omitempty"`
+	RetryAt   time.Time `json:",omitempty"`
+}
+
+var (
+	g_snoozeMu     sync.Mutex
+	g_snoozed      map[string]*SnoozeEntry
+	chSnoozeWakeUp chan struct{}
+)
+
+func snoozeFolder() string {
+	if g_config.SnoozeFolder != "" {
+		return g_config.SnoozeFolder
+	}
+	return snoozeFolderDefault
+}
+
+func snoozeUntilKeyword(wakeAt time.Time) string {
+	return fmt.Sprintf("%s%d", snoozeKeywordPrefix, wakeAt.Unix())
+}
+
+func snoozeWakeAtFromFlags(flags []string) (time.Time, bool) {
+	n := len(snoozeKeywordPrefix)
+	for _, flag := range flags {
+		if len(flag) <= n || !strings.EqualFold(flag[:n], snoozeKeywordPrefix) {
+			continue
+		}
+		unix, err := strconv.ParseInt(flag[n:], 10, 64)
+		if err == nil {
+			return time.Unix(unix, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// when a due entry is tried next, later after each failed try
+func (entry *SnoozeEntry) nextTry() time.Time {
+	if entry.Attempts == 0 {
+		return entry.WakeAt
+	}
+	return entry.RetryAt
+}
+
+// loads what's snoozed before anything can be snoozed, the server is only
+// checked once the worker starts
+func snoozeInit() {
+	chSnoozeWakeUp = make(chan struct{}, 1)
+	g_snoozed = make(map[string]*SnoozeEntry)
+
+	data, err := os.ReadFile(dataFilePath("snoozed.json"))
+	if err == nil {
+		var entries []*SnoozeEntry
+		err = json.Unmarshal(data, &entries)
+		for _, entry := range entries {
+			g_snoozed[entry.MessageId] = entry
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to load snoozed emails: %v", err)
+	}
+}
+
+func snoozeSaveLocked() {
+	Assert(g_snoozeMu.TryLock() == false, "g_snoozeMu needs to be locked")
+	entries := make([]*SnoozeEntry, 0, len(g_snoozed))
+	for _, entry := range g_snoozed {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].WakeAt.Before(entries[j].WakeAt)
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(dataFilePath("snoozed.json"), data)
+	}
+	if err != nil {
+		log.Printf("unable to save snoozed emails: %v", err)
+	}
+}
+
+// the keywords on the server are the source of truth for what's snoozed
+// until when, snoozed.json is only rebuilt from them, so emails snoozed on
+// another install or before snoozed.json was lost still wake up
+func snoozeSyncFromServer() error {
+	var imapEmails []*imap.Message
+	err := imapCommand(snoozeFolder(), func(clt *client.Client) error {
+		if clt.Mailbox().Messages == 0 {
+			return nil
+		}
+		seqSet := new(imap.SeqSet)
+		seqSet.AddRange(1, clt.Mailbox().Messages)
+		chEmails := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- clt.Fetch(seqSet,
+				[]imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope}, chEmails)
+		}()
+		for imapEmail := range chEmails {
+			imapEmails = append(imapEmails, imapEmail)
+		}
+		return <-done
+	})
+	if err != nil {
+		return err
+	}
+
+	g_snoozeMu.Lock()
+	defer g_snoozeMu.Unlock()
+	snoozeSyncLocked(imapEmails)
+	snoozeSaveLocked()
+	return nil
+}
+
+func snoozeSyncLocked(imapEmails []*imap.Message) {
+	Assert(g_snoozeMu.TryLock() == false, "g_snoozeMu needs to be locked")
+	onServer := make(map[string]bool)
+	for _, imapEmail := range imapEmails {
+		if imapEmail.Envelope == nil || imapEmail.Envelope.MessageId == "" {
+			continue
+		}
+		wakeAt, ok := snoozeWakeAtFromFlags(imapEmail.Flags)
+		if !ok {
+			continue
+		}
+		messageId := imapEmail.Envelope.MessageId
+		onServer[messageId] = true
+		entry, ok := g_snoozed[messageId]
+		if !ok || !entry.WakeAt.Equal(wakeAt) {
+			g_snoozed[messageId] = &SnoozeEntry{
+				MessageId: messageId,
+				Subject:   decodeHeaderText(imapEmail.Envelope.Subject),
+				WakeAt:    wakeAt,
+			}
+		}
+	}
+
+	// woken up or moved out of the snooze folder by another client
+	for messageId := range g_snoozed {
+		if !onServer[messageId] {
+			delete(g_snoozed, messageId)
+		}
+	}
+}
+
+func snoozeWorker() {
+	err := snoozeSyncFromServer()
+	if err != nil {
+		log.Printf("unable to read snoozed emails from server: %v", err)
+	}
+
+	for {
+		snoozeWakeUpDue(time.Now())
+
+		wait := snoozePollInterval
+		g_snoozeMu.Lock()
+		for _, entry := range g_snoozed {
+			wait = min(wait, max(time.Until(entry.nextTry()), time.Second))
+		}
+		g_snoozeMu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-chSnoozeWakeUp:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+var errSnoozeGone = errors.New("no longer on the server")
+
+func snoozeWakeUpDue(now time.Time) {
+	g_snoozeMu.Lock()
+	var due []SnoozeEntry
+	for _, entry := range g_snoozed {
+		if !entry.nextTry().After(now) {
+			due = append(due, *entry)
+		}
+	}
+	g_snoozeMu.Unlock()
+
+	for _, entry := range due {
+		err := imapCommand(snoozeFolder(), func(clt *client.Client) error {
+			criteria := imap.NewSearchCriteria()
+			criteria.WithFlags = []string{snoozeKeyword}
+			criteria.Header.Add("Message-Id", entry.MessageId)
+			uids, err := clt.UidSearch(criteria)
+			if err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return errSnoozeGone
+			}
+
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(uids...)
+			flags := []interface{}{imap.SeenFlag, snoozeKeyword,
+				snoozeUntilKeyword(entry.WakeAt)}
+			err = clt.UidStore(seqSet,
+				imap.FormatFlagsOp(imap.RemoveFlags, true), flags, nil)
+			if err != nil {
+				return err
+			}
+			return clt.UidMove(seqSet, imapIdleFolder)
+		})
+
+		g_snoozeMu.Lock()
+		if err != nil && err != errSnoozeGone {
+			if current, ok := g_snoozed[entry.MessageId]; ok {
+				current.Attempts++
+				backoff := snoozeRetryBackoffMin << min(current.Attempts-1, 16)
+				current.RetryAt = now.Add(min(backoff, snoozeRetryBackoffMax))
+			}
+		} else {
+			delete(g_snoozed, entry.MessageId)
+		}
+		snoozeSaveLocked()
+		g_snoozeMu.Unlock()
+
+		switch {
+		case err == errSnoozeGone:
+			updateStatusBar(fmt.Sprintf(
+				"Snoozed email \"%s\" is gone from %s, forgot about it",
+				entry.Subject, snoozeFolder()))
+		case err != nil:
+			// only the first failure is shown, retries are quiet
+			if entry.Attempts == 0 {
+				updateStatusBar(fmt.Sprintf(
+					"Unable to wake up snoozed email \"%s\", will retry: %v",
+					entry.Subject, err))
+			}
+			log.Printf("unable to wake up snoozed email %s: %v",
+				entry.MessageId, err)
+		default:
+			updateStatusBar(fmt.Sprintf(
+				"Snoozed email \"%s\" is back in %s", entry.Subject,
+				imapIdleFolder))
+		}
+	}
+}
+
+func snoozeEmail(email Email, wakeAt time.Time) {
+	if email.messageId == "" {
+		updateStatusBar("Can't snooze an email without a Message-Id")
+		return
+	}
+
+	err := imapCommand(email.folder, func(clt *client.Client) error {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(email.uid)
+		err := clt.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true),
+			[]interface{}{snoozeKeyword, snoozeUntilKeyword(wakeAt)}, nil)
+		if err != nil {
+			return fmt.Errorf("unable to set snooze keyword: %v", err)
+		}
+
+		// fails when the folder is already there, which is fine
+		_ = clt.Create(snoozeFolder())
+		return clt.UidMove(seqSet, snoozeFolder())
+	})
+	if err != nil {
+		updateStatusBar(fmt.Sprintf("Unable to snooze email: %v", err))
+		return
+	}
+
+	g_snoozeMu.Lock()
+	g_snoozed[email.messageId] = &SnoozeEntry{
+		MessageId: email.messageId,
+		Subject:   email.subject,
+		WakeAt:    wakeAt,
+	}
+	snoozeSaveLocked()
+	g_snoozeMu.Unlock()
+
+	select {
+	case chSnoozeWakeUp <- struct{}{}:
+	default:
+	}
+
+	if email.folder != imapIdleFolder {
+		notifyEmailMoved(email.folder, email.uid)
+	}
+	updateStatusBar(fmt.Sprintf("Snoozed \"%s\" until %s",
+		email.subject, FormatLocalizedTime(wakeAt)))
+}
+
+func snoozeSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.previewUid == 0 || g_ui.folderSelected == outboxFolder {
+		updateStatusBar("No message selected to snooze")
+		return
+	}
+
+	email := cachedEmailFromUid(g_ui.folderSelected, g_ui.previewUid)
+	showPrompt("Snooze until:", "e.g. +3h, tomorrow, mon 9am",
+		func(text string) {
+			wakeAt, err := ParseHumanTime(text, time.Now())
+			if err != nil {
+				updateStatusBar(fmt.Sprintf("Can't snooze: %v", err))
+				return
+			}
+			if !wakeAt.After(time.Now()) {
+				updateStatusBar("Can't snooze until a time in the past")
+				return
+			}
+			go snoozeEmail(email, wakeAt)
+		})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestSnoozeSyncRebuildsFromServer(t *testing.T) {
+	testModelInit(t)
+	snoozeInit()
+	wakeAt := time.Date(2026, 10, 22, 9, 0, 0, 0, time.UTC)
+	g_snoozed["<gone@example.com>"] = &SnoozeEntry{
+		MessageId: "<gone@example.com>", WakeAt: wakeAt}
+	g_snoozed["<moved@example.com>"] = &SnoozeEntry{
+		MessageId: "<moved@example.com>", WakeAt: wakeAt.Add(-time.Hour)}
+
+	imapEmails := []*imap.Message{
+		// snoozed on another install, we've never seen it
+		{Flags: []string{snoozeKeyword, snoozeUntilKeyword(wakeAt)},
+			Envelope: &imap.Envelope{MessageId: "<other@example.com>",
+				Subject: "=?utf-8?q?caf=C3=A9?="}},
+		// snoozed again for later by another install
+		{Flags: []string{imap.SeenFlag, snoozeKeyword,
+			snoozeUntilKeyword(wakeAt)},
+			Envelope: &imap.Envelope{MessageId: "<moved@example.com>"}},
+		// not snoozed by us
+		{Flags: []string{imap.SeenFlag},
+			Envelope: &imap.Envelope{MessageId: "<filed@example.com>"}},
+	}
+	g_snoozeMu.Lock()
+	snoozeSyncLocked(imapEmails)
+	snoozeSaveLocked()
+	g_snoozeMu.Unlock()
+
+	// as if snoozed.json was lost in between
+	snoozeInit()
+	if len(g_snoozed) != 2 {
+		t.Errorf("snoozed %+v, want other and moved", g_snoozed)
+	}
+	other := g_snoozed["<other@example.com>"]
+	if other == nil || !other.WakeAt.Equal(wakeAt) || other.Subject != "café" {
+		t.Errorf("snoozed on another install %+v", other)
+	}
+	if moved := g_snoozed["<moved@example.com>"]; moved == nil ||
+		!moved.WakeAt.Equal(wakeAt) {
+		t.Errorf("snoozed again %+v, want it to wake up at %v", moved, wakeAt)
+	}
+}
+
+func TestSnoozeWakeAtFromFlags(t *testing.T) {
+	wakeAt := time.Unix(1760950800, 0)
+	got, ok := snoozeWakeAtFromFlags([]string{imap.SeenFlag, snoozeKeyword,
+		"$snoozeduntil-1760950800"})
+	if !ok || !got.Equal(wakeAt) {
+		t.Errorf("snoozeWakeAtFromFlags = %v, %v, want %v", got, ok, wakeAt)
+	}
+	for _, flags := range [][]string{
+		{snoozeKeyword}, {"$SnoozedUntil-"}, {"$SnoozedUntil-soon"},
+	} {
+		if got, ok := snoozeWakeAtFromFlags(flags); ok {
+			t.Errorf("snoozeWakeAtFromFlags(%q) = %v", flags, got)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	sortthread "github.com/emersion/go-imap-sortthread"
+)
+
+// what the emails table is sorted by, cycled with o and reversed with O
+const (
+	emailSortDate    = "date"
+	emailSortArrival = "arrival"
+	emailSortFrom    = "from"
+	emailSortSubject = "subject"
+	emailSortSize    = "size"
+	emailSortUnread  = "unread"
+	emailSortFlagged = "flagged"
+)
+
+var emailSortFields = []string{
+	emailSortDate, emailSortArrival, emailSortFrom, emailSortSubject,
+	emailSortSize, emailSortUnread, emailSortFlagged,
+}
+
+// persisted in sort.json, keyed by folder. Dates and sizes go newest and
+// largest first, names a to z, unread and flagged emails first, Reverse flips
+// that around
+type EmailSort struct {
+	Field   string
+	Reverse bool
+}
+
+func (order EmailSort) String() string {
+	s := "by " + order.Field
+	if order.Reverse {
+		s += ", reversed"
+	}
+	return s
+}
+
+// guarded by g_emailsMu, since the cached emails of a folder are kept sorted
+// by it
+var g_emailSortFromFolder map[string]EmailSort
+
+func emailSortInit() {
+	g_emailSortFromFolder = make(map[string]EmailSort)
+	data, err := os.ReadFile(dataFilePath("sort.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &g_emailSortFromFolder)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to load folder sort orders: %v", err)
+	}
+}
+
+func emailSortSave(sortFromFolder map[string]EmailSort) {
+	data, err := json.MarshalIndent(sortFromFolder, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(dataFilePath("sort.json"), data)
+	}
+	if err != nil {
+		log.Printf("unable to save folder sort orders: %v", err)
+	}
+}
+
+func emailSortFromFolderLocked(folder string) EmailSort {
+	Assert(g_emailsMu.TryLock() == false, "g_emailsMu needs to be locked")
+	order, ok := g_emailSortFromFolder[folder]
+	if !ok || !slices.Contains(emailSortFields, order.Field) {
+		return EmailSort{Field: emailSortDate}
+	}
+	return order
+}
+
+func cachedEmailSortFromFolder(folder string) EmailSort {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	return emailSortFromFolderLocked(folder)
+}
+
+// sets the order and resorts the cached emails of the folder to match, read
+// or flagged emails are only moved here, so rows don't jump away from under
+// the cursor while reading
+func cachedEmailSortSet(folder string, order EmailSort) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	g_emailSortFromFolder[folder] = order
+	emails := g_emailsFromFolder[folder]
+	for _, email := range emails {
+		email.sortedUnread = !email.isRead
+		email.sortedFlagged = email.isFlagged
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emailCompareLocked(emails[i], emails[j])
+	})
+	sortFromFolder := make(map[string]EmailSort, len(g_emailSortFromFolder))
+	for folder, order := range g_emailSortFromFolder {
+		sortFromFolder[folder] = order
+	}
+	g_emailsMu.Unlock()
+	emailSortSave(sortFromFolder)
+}
+
+// moves the orders of a renamed folder and the folders under it to their
+// new names
+func cachedEmailSortRenameFolder(folder string, name string, delimiter string) {
+	g_emailsMu.Lock()
+	renamedOrders := make(map[string]EmailSort)
+	for key, order := range g_emailSortFromFolder {
+		if renamed, ok := folderRenamed(key, folder, name, delimiter); ok {
+			renamedOrders[renamed] = order
+			delete(g_emailSortFromFolder, key)
+		}
+	}
+	if len(renamedOrders) == 0 {
+		g_emailsMu.Unlock()
+		return
+	}
+	for key, order := range renamedOrders {
+		g_emailSortFromFolder[key] = order
+	}
+	sortFromFolder := make(map[string]EmailSort, len(g_emailSortFromFolder))
+	for key, order := range g_emailSortFromFolder {
+		sortFromFolder[key] = order
+	}
+	g_emailsMu.Unlock()
+	emailSortSave(sortFromFolder)
+}
+
+func cachedEmailsSort(folder string, emails []*Email) {
+	assertValidFolderName(folder)
+	g_emailsMu.Lock()
+	defer g_emailsMu.Unlock()
+	sort.Slice(emails, func(i, j int) bool {
+		return emailCompareLocked(emails[i], emails[j])
+	})
+}
+
+// re: and fwd: prefixes don't count, like the base subject of server SORT
+func emailBaseSubject(subject string) string {
+	subject = strings.ToLower(strings.TrimSpace(subject))
+	for {
+		trimmed := subject
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			trimmed = strings.TrimPrefix(trimmed, prefix)
+		}
+		trimmed = strings.TrimSpace(trimmed)
+		if trimmed == subject {
+			return subject
+		}
+		subject = trimmed
+	}
+}
+
+func emailSortName(email *Email) string {
+	if email.fromName != "" {
+		return strings.ToLower(email.fromName)
+	}
+	return strings.ToLower(email.fromAddress)
+}
+
+// whether e1 goes above e2 in the emails table, ties are broken by date and
+// then uid so emails are never equal
+func emailCompareLocked(e1 *Email, e2 *Email) bool {
+	order := emailSortFromFolderLocked(e1.folder)
+	if order.Reverse {
+		e1, e2 = e2, e1
+	}
+
+	switch order.Field {
+	case emailSortArrival:
+		if !e1.arrival.Equal(e2.arrival) {
+			return e1.arrival.After(e2.arrival)
+		}
+	case emailSortFrom:
+		if from1, from2 := emailSortName(e1), emailSortName(e2); from1 != from2 {
+			return from1 < from2
+		}
+	case emailSortSubject:
+		subject1 := emailBaseSubject(e1.subject)
+		subject2 := emailBaseSubject(e2.subject)
+		if subject1 != subject2 {
+			return subject1 < subject2
+		}
+	case emailSortSize:
+		if e1.size != e2.size {
+			return e1.size > e2.size
+		}
+	case emailSortUnread:
+		if e1.sortedUnread != e2.sortedUnread {
+			return e1.sortedUnread
+		}
+	case emailSortFlagged:
+		if e1.sortedFlagged != e2.sortedFlagged {
+			return e1.sortedFlagged
+		}
+	}
+
+	if e1.date == e2.date {
+		return e1.uid > e2.uid
+	}
+	return e1.date.After(e2.date)
+}
+
+// the order the server's SORT downloads a folder in, so the emails at the
+// top of the table come first. Unread and flagged have no SORT key so those
+// come by date. Either way the table itself is sorted locally
+func imapSortCriteria(order EmailSort) []sortthread.SortCriterion {
+	criterion := sortthread.SortCriterion{Field: sortthread.SortDate,
+		Reverse: true}
+	switch order.Field {
+	case emailSortArrival:
+		criterion = sortthread.SortCriterion{Field: sortthread.SortArrival,
+			Reverse: true}
+	case emailSortFrom:
+		criterion = sortthread.SortCriterion{Field: sortthread.SortFrom}
+	case emailSortSubject:
+		criterion = sortthread.SortCriterion{Field: sortthread.SortSubject}
+	case emailSortSize:
+		criterion = sortthread.SortCriterion{Field: sortthread.SortSize,
+			Reverse: true}
+	case emailSortUnread, emailSortFlagged:
+		return []sortthread.SortCriterion{criterion}
+	}
+	if order.Reverse {
+		criterion.Reverse = !criterion.Reverse
+	}
+	return []sortthread.SortCriterion{criterion}
+}
+
+// resorts the selected folder and rebuilds the emails table from the cache,
+// keeping the selected email selected
+func emailsTableSort(order EmailSort) {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	folder := g_ui.folderSelected
+	if folder == "" || folder == outboxFolder {
+		updateStatusBar("The outbox is always sorted by when emails are sent")
+		return
+	}
+
+	cachedEmailSortSet(folder, order)
+	g_ui.emailsUidListAll = g_ui.emailsUidListAll[:0]
+	for _, email := range cachedEmailsFromFolder(folder) {
+		g_ui.emailsUidListAll = append(g_ui.emailsUidListAll, email.uid)
+	}
+	g_ui.emailsPegSelectionToTop = false
+	emailsTableShowRows(emailsTableSelectedUid())
+
+	updateStatusBar(fmt.Sprintf("Sorted %s %s", folder, order))
+}
+
+func emailsTableSortCycle() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderSelected == "" || g_ui.folderSelected == outboxFolder {
+		emailsTableSort(EmailSort{})
+		return
+	}
+	order := cachedEmailSortFromFolder(g_ui.folderSelected)
+	i := slices.Index(emailSortFields, order.Field)
+	emailsTableSort(EmailSort{
+		Field: emailSortFields[(i+1)%len(emailSortFields)],
+	})
+}
+
+func emailsTableSortReverse() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.folderSelected == "" || g_ui.folderSelected == outboxFolder {
+		emailsTableSort(EmailSort{})
+		return
+	}
+	order := cachedEmailSortFromFolder(g_ui.folderSelected)
+	order.Reverse = !order.Reverse
+	emailsTableSort(order)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCachedEmailSortRenameFolder(t *testing.T) {
+	testModelInit(t)
+	byFrom := EmailSort{Field: emailSortFrom}
+	bySize := EmailSort{Field: emailSortSize, Reverse: true}
+	bySubject := EmailSort{Field: emailSortSubject}
+	cachedEmailSortSet("Work", byFrom)
+	cachedEmailSortSet("Work/2026", bySize)
+	cachedEmailSortSet("Workshop", bySubject)
+
+	cachedEmailSortRenameFolder("Work", "Jobs", "/")
+	// read back the way they were saved
+	emailSortInit()
+	want := map[string]EmailSort{
+		"Jobs": byFrom, "Jobs/2026": bySize, "Workshop": bySubject,
+		"Work": {Field: emailSortDate}, "Work/2026": {Field: emailSortDate},
+	}
+	for folder, order := range want {
+		if got := cachedEmailSortFromFolder(folder); got != order {
+			t.Errorf("%s sorted %v, want %v", folder, got, order)
+		}
+	}
+}
+
+func TestFolderRenamed(t *testing.T) {
+	tests := []struct {
+		item, delimiter string
+		want            string
+		ok              bool
+	}{
+		{"Work", "/", "Jobs", true},
+		{"Work/2026/q1", "/", "Jobs/2026/q1", true},
+		{"Work.2026", ".", "Jobs.2026", true},
+		{"Workshop", "/", "", false},
+		{"Work/2026", "", "", false},
+		{"Inbox", "/", "", false},
+	}
+	for _, test := range tests {
+		got, ok := folderRenamed(test.item, "Work", "Jobs", test.delimiter)
+		if got != test.want || ok != test.ok {
+			t.Errorf("folderRenamed(%q) = %q, %v, want %q, %v", test.item,
+				got, ok, test.want, test.ok)
+		}
+	}
+}
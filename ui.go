@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,6 +22,8 @@ const (
 	coEmailStatusBarText = coKagiYellow
 	coEmailUnread        = "#cccccc"
 	coEmailRead          = "#5c5470"
+	coEmailMarked        = coKagiYellow
+	coWarningText        = "#ff6b6b"
 
 	coSelectionFocused      = coKagiPurple
 	coSelectionTextFocused  = "#000000"
@@ -35,13 +38,18 @@ func uiInit() {
 		}
 
 		folder := g_ui.folderSelected
+		// only sorted by date are the recent ones all at the top
+		byDate := cachedEmailSortFromFolder(folder) ==
+			EmailSort{Field: emailSortDate}
 		dirty := false
 		for row := 0; row < g_ui.emailsTable.GetRowCount(); row++ {
 			uid := g_ui.emailsUidList[row]
 			email := cachedEmailFromUid(folder, uid)
 
 			du := time.Since(email.date)
-			if du > time.Hour*24 {
+			if du > time.Hour*24 && !byDate {
+				continue
+			} else if du > time.Hour*24 {
 				colText := g_ui.emailsTable.GetCell(row, 2).Text
 				colText_ := FormatAsRelativeTimeIfWithin24Hours(email.date)
 				Assert(
@@ -91,7 +99,12 @@ func notifyFetchAllStarted(folder string, n int, cancel context.CancelFunc) {
 		// switching folders initialization
 		g_ui.emailsTable.Clear()
 		g_ui.emailsUidList = g_ui.emailsUidList[:0]
+		g_ui.emailsUidListAll = g_ui.emailsUidListAll[:0]
+		g_ui.markedUids = make(map[uint32]bool)
+		g_ui.markAnchorUid = 0
+		filterReset()
 		g_ui.folderSelected = folder
+		setHintsBarText()
 		trace("g_ui.emailsPegSelectionToTop set")
 		g_ui.emailsPegSelectionToTop = true
 		g_ui.previewUid = 0
@@ -115,13 +128,15 @@ func onFetchAllFinished(err error, folder string) {
 		}
 	} else {
 		Assert(
-			g_ui.emailsTable.GetRowCount() == g_ui.folderItemCount,
+			len(g_ui.emailsUidListAll) == g_ui.folderItemCount,
 			"notifyFetchAllFinished should have downloaded everything",
 		)
 		updateStatusBar(fmt.Sprintf(
 			"Folder up to date with %d emails as of %s", g_ui.folderItemCount,
 			time.Now().Format(time.Stamp),
 		))
+		row, _ := g_ui.emailsTable.GetSelection()
+		prefetchAround(row)
 	}
 }
 
@@ -134,8 +149,7 @@ func notifyFetchAllFinished(err error, folder string) {
 
 func notifyFetchLatestStarted(folder string, n int, cancel context.CancelFunc) {
 	g_ui.app.QueueUpdateDraw(func() {
-		row, _ := g_ui.emailsTable.GetSelection()
-		g_ui.emailUidSelectedBeforeDownload = g_ui.emailsUidList[row]
+		g_ui.emailUidSelectedBeforeDownload = emailsTableSelectedUid()
 		onFetchStarted(folder, n, cancel)
 	})
 }
@@ -162,6 +176,7 @@ func notifyFetchEmailBodyStarted(folder string, uid uint32) {
 
 const (
 	notifyFetchEmailPulledFromCache = 1 << iota
+	notifyFetchEmailPulledFromDisk
 )
 
 func notifyFetchEmailBodyFinished(
@@ -177,10 +192,19 @@ func notifyFetchEmailBodyFinished(
 	var s string
 	if flags&notifyFetchEmailPulledFromCache != 0 {
 		s = fmt.Sprintf("Found cached email message: %d, size of %s", uid, size)
+	} else if flags&notifyFetchEmailPulledFromDisk != 0 {
+		s = fmt.Sprintf("Read cached email message: %d back from disk, size of %s",
+			uid, size)
 	} else {
 		s = fmt.Sprintf("Downloaded email message: %d, size of %s", uid, size)
+		if email.sizeDownloaded < email.size {
+			s += fmt.Sprintf(", downloaded %s of it, saving %s",
+				FormatHumanReadableSize(int64(email.sizeDownloaded)),
+				FormatHumanReadableSize(
+					int64(email.size-email.sizeDownloaded)))
+		}
 	}
-	updateStatusBar(s)
+	updateStatusBar(s + ", " + bodyCacheStats())
 
 	body := email.body
 	if body == "" {
@@ -189,11 +213,62 @@ func notifyFetchEmailBodyFinished(
 	previewPaneSetBody(uid, body)
 }
 
+// counts down in the status bar while a sent email is held in the outbox
+func notifyUndoSendStarted(id uint32, email Email, sendAt time.Time) {
+	g_ui.app.QueueUpdateDraw(func() { g_ui.undoSendId = id })
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			remaining := time.Until(sendAt)
+			if remaining <= 0 {
+				break
+			}
+			g_ui.app.QueueUpdateDraw(func() {
+				if g_ui.undoSendId != id {
+					return
+				}
+				updateStatusBar(fmt.Sprintf(
+					"Sending email to: %s in %ds, [%s]u[%s]:Undo",
+					email.toAddress, int(remaining.Seconds()+0.5),
+					coShortcutText, coMainStatusBarText))
+			})
+			<-ticker.C
+		}
+
+		g_ui.app.QueueUpdateDraw(func() {
+			if g_ui.undoSendId == id {
+				g_ui.undoSendId = 0
+			}
+		})
+	}()
+}
+
+// for emails we moved out of a folder that isn't being idled on
+func notifyEmailMoved(folder string, uid uint32) {
+	g_ui.app.QueueUpdateDraw(func() {
+		if cachedEmailRemoveViaUid(folder, uid) &&
+			g_ui.folderSelected == folder {
+			removeEmailFromList(uid)
+		}
+	})
+}
+
+// for emails we moved into a folder that isn't being idled on
+func notifyFolderChanged(folder string) {
+	g_ui.app.QueueUpdate(func() {
+		if g_ui.folderSelected == folder {
+			go fetchFolder(folder, fetchFolderOptionLatestOnly)
+		}
+	})
+}
+
 func notifyEmailDeleted(folder string, seqNum uint32) {
 	g_ui.app.QueueUpdateDraw(func() {
-		k := cachedEmailRemoveViaSeqNum(folder, seqNum)
-		if k != -1 {
-			removeEmailFromList(k)
+		uid := cachedEmailRemoveViaSeqNum(folder, seqNum)
+		if uid != 0 {
+			removeEmailFromList(uid)
 		}
 	})
 }
@@ -207,8 +282,11 @@ func previewPaneSetBody(uid uint32, body string) {
 			uid,
 			email.subject,
 		)
-		if g_ui.previewUid == uid {
+		if g_ui.previewUid == uid && g_ui.previewView == previewViewBody {
 			g_ui.previewText.SetText(body, false)
+			if g_ui.mode == UIModeNormal && email.security != "" {
+				g_ui.previewText.SetTitle("Preview, " + email.security)
+			}
 			// if we are in UIModeQuickReply, that means they hit r on this
 			// message, but it hadn't downloaded yet. But now that we have it
 			// go ahead transform the body into a reply and set focus
@@ -225,23 +303,98 @@ func previewPaneSetReply() {
 	Assert(g_ui.mode == UIModeQuickReply, "not in quick reply mode")
 
 	email := cachedEmailFromUid(g_ui.folderSelected, g_ui.previewUid)
+	identity := identityForReply(email)
+	signatureBlock := identity.signatureBlock()
+	attribution := fmt.Sprintf("On %s %s wrote:",
+		FormatLocalizedTime(email.date), email.fromName)
+	originalText := stripSignature(g_ui.previewText.GetText())
+
+	if g_ui.quickReplyInline {
+		reply := inlineReplyText(attribution, originalText, identity)
+		g_ui.quickReplyQuoted = reply
+		g_ui.previewText.SetText(reply, false)
+		g_ui.app.SetFocus(g_ui.previewText)
+		onFocusChange()
+		return
+	}
 
 	var reply strings.Builder
-	reply.WriteString(fmt.Sprintf("\n\nOn %s %s wrote:\n",
-		FormatLocalizedTime(email.date), email.fromName))
+	reply.WriteString("\n\n")
+	if signatureBlock != "" && identity.replySignatureAbove() {
+		reply.WriteString(signatureBlock + "\n")
+	}
+	reply.WriteString(attribution + "\n")
 
-	originalText := g_ui.previewText.GetText()
 	for _, line := range strings.Split(originalText, "\n") {
 		line = ">" + line
 		reply.WriteString(line + "\n")
 	}
+	if signatureBlock != "" && !identity.replySignatureAbove() {
+		reply.WriteString("\n" + signatureBlock)
+	}
 
 	g_ui.previewText.SetText(reply.String(), false)
 	g_ui.app.SetFocus(g_ui.previewText)
 	onFocusChange()
 }
 
-func composeSetForward() {
+// attachments that were skipped when the body was downloaded, or that were
+// evicted with it, are downloaded before compose opens
+func forwardSelected() {
+	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
+	if g_ui.previewUid == 0 {
+		updateStatusBar("No message selected to forward")
+		return
+	}
+
+	// the forward quotes what's in the preview
+	if g_ui.previewView != previewViewBody {
+		previewPaneSetView(previewViewBody)
+	}
+
+	email := cachedEmailFromUid(g_ui.folderSelected, g_ui.previewUid)
+	pending := 0
+	var pendingSize int64
+	for _, attachment := range email.attachments {
+		if attachment.data == nil && attachment.part != nil {
+			pending++
+			pendingSize += attachment.size
+		}
+	}
+	if pending == 0 && email.body != "" {
+		setUIMode(UIModeCompose)
+		composeSetForward(email.attachments)
+		return
+	}
+
+	if email.body == "" {
+		updateStatusBar("Loading the email to forward")
+	} else {
+		updateStatusBar(fmt.Sprintf(
+			"Downloading %d attachments to forward, %s",
+			pending, FormatHumanReadableSize(pendingSize)))
+	}
+	go func() {
+		attachments, err := fetchEmailForwardAttachments(email.folder,
+			email.uid)
+		g_ui.app.QueueUpdateDraw(func() {
+			if err != nil {
+				updateStatusBar(fmt.Sprintf(
+					"Unable to download attachments to forward: %v", err))
+				return
+			}
+			updateStatusBar(fmt.Sprintf("Forwarding with %d attachments",
+				len(attachments)))
+			if g_ui.mode != UIModeNormal || g_ui.previewUid != email.uid {
+				return
+			}
+			setUIMode(UIModeCompose)
+			composeSetForward(attachments)
+		})
+	}()
+}
+
+func composeSetForward(attachments []Attachment) {
 	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
 	Assert(g_ui.previewUid != 0, "no preview message selected")
 	Assert(g_ui.mode == UIModeCompose, "not in compose mode")
@@ -262,22 +415,28 @@ func composeSetForward() {
 		),
 	)
 
-	fnGetFormItem := g_ui.composeForm.GetFormItem
-	fnGetFormItem(0).(*tview.InputField).SetText("")
-	fnGetFormItem(1).(*tview.InputField).SetText("")
-	fnGetFormItem(2).(*tview.InputField).SetText("Fwd: " + email.subject)
-	fnGetFormItem(3).(*tview.TextArea).SetText(reply.String(), true)
-	g_ui.composeForm.SetFocus(0)
+	identity := identityForReply(email)
+	body := reply.String()
+	if signatureBlock := identity.signatureBlock(); signatureBlock != "" {
+		body = "\n\n" + signatureBlock + "\n" + body
+	}
+
+	composeSetFields("", "", "Fwd: "+email.subject, body)
+	composeSetIdentity(identity)
+	composeSetAttachments(attachments)
+	composeFocusTo()
 	onFocusChange()
 }
 
 func composeClear() {
-	fnGetFormItem := g_ui.composeForm.GetFormItem
-	fnGetFormItem(0).(*tview.InputField).SetText("")
-	fnGetFormItem(1).(*tview.InputField).SetText("")
-	fnGetFormItem(2).(*tview.InputField).SetText("")
-	fnGetFormItem(3).(*tview.TextArea).SetText("", true)
-	g_ui.composeForm.SetFocus(0)
+	identity := identityDefault()
+	body := ""
+	if signatureBlock := identity.signatureBlock(); signatureBlock != "" {
+		body = "\n\n" + signatureBlock
+	}
+	composeSetFields("", "", "", body)
+	composeSetIdentity(identity)
+	composeFocusTo()
 	onFocusChange()
 }
 
@@ -289,9 +448,22 @@ func updateEmailStatusBarWithSelection() {
 	}
 
 	k, _ := g_ui.emailsTable.GetSelection()
-	updateEmailStatusBar(fmt.Sprintf(
-		"Email %d of %d", k+1, g_ui.emailsTable.GetRowCount(),
-	))
+	text := fmt.Sprintf("Email %d of %d", k+1, g_ui.emailsTable.GetRowCount())
+	if emailFilterActive() {
+		text = fmt.Sprintf("Email %d, %d of %d match", k+1,
+			len(g_ui.emailsUidList), len(g_ui.emailsUidListAll))
+		if len(g_ui.emailsUidList) == 0 {
+			text = fmt.Sprintf("0 of %d match", len(g_ui.emailsUidListAll))
+		}
+	}
+	if order := cachedEmailSortFromFolder(g_ui.folderSelected); order !=
+		(EmailSort{Field: emailSortDate}) {
+		text += ", sorted " + order.String()
+	}
+	if len(g_ui.markedUids) > 0 {
+		text += fmt.Sprintf(", %d marked", len(g_ui.markedUids))
+	}
+	updateEmailStatusBar(text)
 }
 
 func updateEmailStatusBar(text string) {
@@ -313,6 +485,10 @@ func onEmailsTableSelectionChange(row int, col int) {
 	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
 	updateEmailStatusBarWithSelection()
 
+	// the filter can leave no rows
+	if row >= len(g_ui.emailsUidList) {
+		return
+	}
 	folder := g_ui.folderSelected
 	uid := g_ui.emailsUidList[row]
 	if g_ui.previewUid == uid {
@@ -330,9 +506,12 @@ func onEmailsTableSelectionChange(row int, col int) {
 	)
 
 	g_ui.previewUid = uid
+	g_ui.previewView = previewViewBody
+	g_ui.previewRaw = nil
 	g_ui.previewText.SetTitle("Preview")
 	g_ui.previewText.SetText("", false)
 	go fetchEmailBody(g_ui.folderSelected, uid)
+	prefetchAround(row)
 }
 
 func updateStatusBar(text string) {
@@ -347,11 +526,35 @@ func updateStatusBar(text string) {
 func setHintsBarText() {
 	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
 	var hints string
-	if g_ui.mode == UIModeNormal {
-		hints = " _Compose _Reply _Forward [F5]:Refresh |"
+	if g_ui.mode == UIModeNormal && g_ui.folderSelected == outboxFolder {
+		hints = " _Edit [Del]:Cancel Send [F5]:Refresh |"
+		hints += " [Tab]:Move Focus Fol_ders _Hints _Preview _Quit"
+	} else if g_ui.mode == UIModeNormal && g_ui.foldersList.HasFocus() {
+		hints = " _New Folder [R]:Rename [D]:Delete _Subscribe"
+		hints += " [S]:Show All/Subscribed |"
+		hints += " [Tab]:Move Focus Fol_ders _Hints _Preview _Quit"
+	} else if g_ui.mode == UIModeNormal {
+		hints = " _Compose _Reply Reply _Inline _Forward Snoo_ze _View Source"
+		hints += " _MIME Parts S_ort [O]:Reverse Sort [/]:Filter [F5]:Refresh |"
+		hints += " [x]:Mark [X]:Mark Range [*]:Mark All [T]:Mark Thread"
+		hints += " [M]:Move _Archive [#]:Delete [!]:Junk _Star [I]:Read [U]:Unread"
+		hints += " _Undo |"
 		hints += " [Tab]:Move Focus Fol_ders _Hints _Preview _Quit"
+	} else if g_ui.mode == UIModeMimeTree {
+		hints = " [Enter]:Show Part _Save Part [|]:Pipe Part [Tab]:Move Focus"
+		hints += " | [Esc]:Close"
+	} else if g_ui.mode == UIModeFilter {
+		hints = " [Ctrl+U]:Unread Only [Ctrl+F]:Flagged Only"
+		hints += " [Ctrl+T]:With Attachments [Enter]:Keep | [Esc]:Clear"
+	} else if g_ui.mode == UIModePrompt {
+		hints = " [Enter]:Ok | [Esc]:Cancel"
+	} else if g_ui.mode == UIModeQuickReply && g_ui.quickReplyInline {
+		hints = " [Ctrl+Enter]:Send [Enter]:Split Quote | [Esc]:Discard"
 	} else if g_ui.mode == UIModeQuickReply {
 		hints = " [Ctrl+Enter]:Send | [Esc]:Discard"
+	} else if g_ui.mode == UIModeCompose &&
+		composeCheckbox(composeLabelMarkdown).IsChecked() {
+		hints = " [Ctrl+Enter]:Send [Ctrl+P]:Preview Markdown | [Esc]:Discard"
 	} else if g_ui.mode == UIModeCompose {
 		hints = " [Ctrl+Enter]:Send | [Esc]:Discard"
 	}
@@ -442,7 +645,9 @@ func updateImapEmailInTable(row int, email Email) {
 	}
 
 	co := coEmailUnread
-	if email.isRead {
+	if g_ui.markedUids[email.uid] {
+		co = coEmailMarked
+	} else if email.isRead {
 		co = coEmailRead
 	}
 	setCell(row, 2, FormatAsRelativeTimeIfWithin24Hours(email.date), co)
@@ -451,7 +656,11 @@ func updateImapEmailInTable(row int, email Email) {
 	} else {
 		setCell(row, 0, email.fromAddress, co)
 	}
-	setCell(row, 1, email.subject, co)
+	subject := email.subject
+	if email.isFlagged {
+		subject = "! " + subject
+	}
+	setCell(row, 1, subject, co)
 }
 
 func insertImapEmailToList(email Email, insertImapEmailOptionFlags uint32) {
@@ -461,31 +670,47 @@ func insertImapEmailToList(email Email, insertImapEmailOptionFlags uint32) {
 			"adding email not from selected folder",
 		)
 
-		i := cachedEmailFromUidsBinarySearch(g_ui.emailsUidList, email)
-		if i < len(g_ui.emailsUidList) && g_ui.emailsUidList[i] == email.uid {
-			updateImapEmailInTable(i, email)
+		i := cachedEmailFromUidsBinarySearch(g_ui.emailsUidListAll, email)
+		if i < len(g_ui.emailsUidListAll) &&
+			g_ui.emailsUidListAll[i] == email.uid {
+			i = cachedEmailFromUidsBinarySearch(g_ui.emailsUidList, email)
+			if i < len(g_ui.emailsUidList) &&
+				g_ui.emailsUidList[i] == email.uid {
+				updateImapEmailInTable(i, email)
+			}
 			return // already added
 		}
 
-		// insert into emailsUidList
-		g_ui.emailsUidList = append(g_ui.emailsUidList, 0)
-		copy(g_ui.emailsUidList[i+1:], g_ui.emailsUidList[i:])
-		g_ui.emailsUidList[i] = email.uid
-
-		// insert into table
-		g_ui.emailsTable.InsertRow(i)
-		updateImapEmailInTable(i, email)
-		Assert(len(g_ui.emailsUidList) == g_ui.emailsTable.GetRowCount(), "")
-
-		// when initially loading before keyboard input, keep top item selected
-		// (items might not be inserted into ui in correct order, but our first
-		// insert will set the selected item--which might then move down
-		if g_ui.emailsPegSelectionToTop {
-			g_ui.emailsTable.Select(0, 0)
+		// insert into emailsUidListAll
+		g_ui.emailsUidListAll = append(g_ui.emailsUidListAll, 0)
+		copy(g_ui.emailsUidListAll[i+1:], g_ui.emailsUidListAll[i:])
+		g_ui.emailsUidListAll[i] = email.uid
+
+		if emailMatchesFilter(email) {
+			// insert into emailsUidList
+			i = cachedEmailFromUidsBinarySearch(g_ui.emailsUidList, email)
+			g_ui.emailsUidList = append(g_ui.emailsUidList, 0)
+			copy(g_ui.emailsUidList[i+1:], g_ui.emailsUidList[i:])
+			g_ui.emailsUidList[i] = email.uid
+
+			// insert into table
+			g_ui.emailsTable.InsertRow(i)
+			updateImapEmailInTable(i, email)
+			Assert(len(g_ui.emailsUidList) == g_ui.emailsTable.GetRowCount(),
+				"")
+
+			// when initially loading before keyboard input, keep top item
+			// selected (items might not be inserted into ui in correct order,
+			// but our first insert will set the selected item--which might
+			// then move down
+			if g_ui.emailsPegSelectionToTop {
+				g_ui.emailsTable.Select(0, 0)
+			}
 		}
 
 		// update statusbar
-		if g_ui.emailsTable.GetRowCount() == g_ui.folderItemCount {
+		n := len(g_ui.emailsUidListAll)
+		if n == g_ui.folderItemCount {
 			updateEmailStatusBarWithSelection()
 		} else {
 			verb := "Downloading"
@@ -493,29 +718,26 @@ func insertImapEmailToList(email Email, insertImapEmailOptionFlags uint32) {
 				verb = "Loading"
 			}
 			updateEmailStatusBar(
-				fmt.Sprintf("%s %d emails", verb, g_ui.folderItemCount-g_ui.emailsTable.GetRowCount()))
+				fmt.Sprintf("%s %d emails", verb, g_ui.folderItemCount-n))
 		}
 
-		n := g_ui.emailsTable.GetRowCount()
 		if n < 100 && n%20 == 0 || n%100 == 0 {
 			g_ui.app.ForceDraw()
 		}
 	})
 }
 
-func removeEmailFromList(i int) {
+func removeEmailFromList(uid uint32) {
 	Assert(IsOnUiThread(), "g_ui access should be syncronized on ui thread")
-	g_ui.emailsTable.RemoveRow(i)
-	g_ui.emailsUidList = append(
-		g_ui.emailsUidList[:i],
-		g_ui.emailsUidList[i+1:]...)
-}
-
-func insertFolderToList(folder string) {
-	g_ui.app.QueueUpdateDraw(func() {
-		g_ui.foldersList.AddItem(
-			getNormalizedImapFolderName(folder), "", 0, nil)
-	})
+	if i := slices.Index(g_ui.emailsUidListAll, uid); i != -1 {
+		g_ui.emailsUidListAll = slices.Delete(g_ui.emailsUidListAll, i, i+1)
+	}
+	delete(g_ui.markedUids, uid)
+	// it might be filtered out
+	if i := slices.Index(g_ui.emailsUidList, uid); i != -1 {
+		g_ui.emailsTable.RemoveRow(i)
+		g_ui.emailsUidList = slices.Delete(g_ui.emailsUidList, i, i+1)
+	}
 }
 
 func setUIMode(mode UIMode) {
@@ -529,12 +751,19 @@ func setUIMode(mode UIMode) {
 		g_ui.previewText.SetTitle("Preview")
 	} else if g_ui.mode == UIModeQuickReply {
 		email := cachedEmailFromUid(g_ui.folderSelected, g_ui.previewUid)
-		g_ui.previewText.SetTitle("Replying to " + email.fromName)
+		title := "Replying to "
+		if g_ui.quickReplyInline {
+			title = "Replying inline to "
+		}
+		g_ui.previewText.SetTitle(title + email.fromName)
 	}
 
 	if g_ui.mode == UIModeCompose {
 		g_ui.pages.SwitchToPage("compose")
 		g_ui.app.SetFocus(g_ui.composeForm)
+	} else if g_ui.mode == UIModeMimeTree {
+		g_ui.pages.SwitchToPage("mime")
+		g_ui.app.SetFocus(g_ui.mimeTree)
 	} else {
 		g_ui.pages.SwitchToPage("main")
 		g_ui.app.SetFocus(g_ui.emailsTable)
@@ -544,6 +773,37 @@ func setUIMode(mode UIMode) {
 	setHintsBarText()
 }
 
+// asks for a line of text over the main or mime tree pane, done is called
+// with it on enter, and not at all on escape
+func showPrompt(label string, placeholder string, done func(text string)) {
+	Assert(IsOnUiThread(), "won't work unless called from ui thread")
+	Assert(g_ui.mode == UIModeNormal || g_ui.mode == UIModeMimeTree,
+		"prompts are only shown from main or mime tree pane")
+
+	g_ui.promptInput.
+		SetLabel(label + " ").
+		SetPlaceholder(placeholder).
+		SetText("").
+		SetDoneFunc(func(key tcell.Key) {
+			text := g_ui.promptInput.GetText()
+			g_ui.mode = g_ui.promptModeBefore
+			g_ui.pages.HidePage("prompt")
+			g_ui.app.SetFocus(g_ui.promptFocusBefore)
+			onFocusChange()
+			setHintsBarText()
+			if key == tcell.KeyEnter {
+				done(text)
+			}
+		})
+
+	g_ui.promptModeBefore = g_ui.mode
+	g_ui.mode = UIModePrompt
+	g_ui.promptFocusBefore = g_ui.app.GetFocus()
+	g_ui.pages.ShowPage("prompt")
+	g_ui.app.SetFocus(g_ui.promptInput)
+	setHintsBarText()
+}
+
 func onFocusChange() {
 	Assert(IsOnUiThread(), "won't work unless called from ui thread")
 
@@ -585,10 +845,21 @@ func onFocusChange() {
 
 	g_ui.previewText.SetBorderColor(previewBorderColor)
 	g_ui.previewText.SetTitleColor(previewBorderColor)
+	// the folders pane has hints of its own
+	setHintsBarText()
+
+	for _, box := range []*tview.Box{g_ui.mimeTree.Box, g_ui.mimePartText.Box} {
+		mimeBorderColor := coBorderFocused
+		if !box.HasFocus() {
+			mimeBorderColor = coBorderInactive
+		}
+		box.SetBorderColor(mimeBorderColor)
+		box.SetTitleColor(mimeBorderColor)
+	}
 
+	// title color is owned by composeUpdateTitle, for warnings
 	composeBorderColor := coBorderFocused
 	g_ui.composeForm.SetBorderColor(composeBorderColor)
-	g_ui.composeForm.SetTitleColor(composeBorderColor)
 
 	g_ui.app.ForceDraw()
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -35,6 +37,33 @@ func Require(condition bool, msg string) {
 	}
 }
 
+const dataDirDefault = "kagimail.data"
+
+// path to a file or directory under the data directory, which is created on
+// first use
+func dataFilePath(name string) string {
+	dir := g_config.DataDir
+	if dir == "" {
+		dir = dataDirDefault
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		log.Printf("unable to create data directory \"%s\": %v", dir, err)
+	}
+	return filepath.Join(dir, name)
+}
+
+// writes via a temporary file and rename, so a crash mid-write never leaves
+// a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func IsOnUiThread() bool {
 	buf := make([]byte, 64)
 	runtime.Stack(buf, false)
@@ -80,3 +109,147 @@ func FormatAsRelativeTimeIfWithin24Hours(ts time.Time) string {
 	}
 	return ts.Format("2 Jan")
 }
+
+// parses when to do something from user input, relative to now, in the local
+// time zone unless one is named at the end (e.g. "9am America/New_York"):
+//
+//	now, +2h, +1d12h, 30m, tomorrow, tomorrow 9am, fri 17:30, 9am,
+//	2026-10-20, 2026-10-20 09:00
+//
+// times without a day mean their next occurrence, days without a time mean
+// 9am on that day
+func ParseHumanTime(text string, now time.Time) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(strings.TrimSpace(text)))
+	if len(fields) == 0 || (len(fields) == 1 && fields[0] == "now") {
+		return now, nil
+	}
+
+	loc := now.Location()
+	if len(fields) > 1 {
+		zone := strings.Fields(strings.TrimSpace(text))[len(fields)-1]
+		if l, err := time.LoadLocation(zone); err == nil &&
+			(strings.Contains(zone, "/") || strings.ToUpper(zone) == zone) {
+			loc = l
+			fields = fields[:len(fields)-1]
+		}
+	}
+	now = now.In(loc)
+
+	// relative durations
+	if len(fields) == 1 {
+		d, err := parseHumanDuration(strings.TrimPrefix(fields[0], "+"))
+		if err == nil {
+			return now.Add(d), nil
+		}
+	}
+	if len(fields) >= 2 && fields[0] == "in" {
+		d, err := parseHumanDuration(strings.Join(fields[1:], ""))
+		if err == nil {
+			return now.Add(d), nil
+		}
+	}
+
+	// day, then optional time of day
+	day := time.Time{}
+	dayFields := 0
+	switch {
+	case fields[0] == "today":
+		day, dayFields = now, 1
+	case fields[0] == "tomorrow":
+		day, dayFields = now.AddDate(0, 0, 1), 1
+	default:
+		for i := 0; i < 7; i++ {
+			weekday := strings.ToLower(time.Weekday(i).String())
+			if fields[0] == weekday || fields[0] == weekday[:3] {
+				daysAhead := (i - int(now.Weekday()) + 7) % 7
+				if daysAhead == 0 {
+					daysAhead = 7
+				}
+				day, dayFields = now.AddDate(0, 0, daysAhead), 1
+			}
+		}
+		for _, layout := range []string{"2006-01-02", "01/02/2006", "2 Jan 2006"} {
+			n := len(strings.Fields(layout))
+			if len(fields) < n {
+				continue
+			}
+			t, err := time.ParseInLocation(
+				layout, strings.Join(fields[:n], " "), loc)
+			if err == nil {
+				day, dayFields = t, n
+				break
+			}
+		}
+		t, err := time.ParseInLocation("2006-01-02t15:04", fields[0], loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	rest := strings.Join(fields[dayFields:], "")
+	if rest == "" {
+		if day.IsZero() {
+			return time.Time{}, fmt.Errorf("don't know when \"%s\" is", text)
+		}
+		rest = "9am"
+	}
+
+	hour, minute, err := parseHumanTimeOfDay(rest)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("don't know when \"%s\" is", text)
+	}
+
+	if day.IsZero() {
+		t := time.Date(
+			now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, loc)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Date(
+		day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc), nil
+}
+
+// like time.ParseDuration, but also takes days and weeks, e.g. "1d12h"
+func parseHumanDuration(text string) (time.Duration, error) {
+	var total time.Duration
+	rest := text
+	for rest != "" {
+		i := strings.IndexAny(rest, "dw")
+		if i == -1 {
+			d, err := time.ParseDuration(rest)
+			if err != nil {
+				return 0, err
+			}
+			return total + d, nil
+		}
+
+		var n int
+		_, err := fmt.Sscanf(rest[:i], "%d", &n)
+		if err != nil || fmt.Sprint(n) != rest[:i] {
+			return 0, fmt.Errorf("invalid duration \"%s\"", text)
+		}
+		unit := 24 * time.Hour
+		if rest[i] == 'w' {
+			unit *= 7
+		}
+		total += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("invalid duration \"%s\"", text)
+	}
+	return total, nil
+}
+
+// e.g. 9am, 9:30pm, 17:30, 17
+func parseHumanTimeOfDay(text string) (int, int, error) {
+	for _, layout := range []string{"3pm", "3:04pm", "15:04", "15"} {
+		t, err := time.Parse(layout, text)
+		if err == nil {
+			return t.Hour(), t.Minute(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid time of day \"%s\"", text)
+}
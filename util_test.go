@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHumanTime(t *testing.T) {
+	// a wednesday afternoon
+	now := time.Date(2026, 10, 21, 14, 30, 0, 0, time.UTC)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"", now},
+		{"now", now},
+		{" NOW ", now},
+		{"+2h", at(10, 21, 16, 30)},
+		{"30m", at(10, 21, 15, 0)},
+		{"+1d12h", at(10, 23, 2, 30)},
+		{"in 2h", at(10, 21, 16, 30)},
+		{"in 1w", at(10, 28, 14, 30)},
+		{"tomorrow", at(10, 22, 9, 0)},
+		{"tomorrow 9am", at(10, 22, 9, 0)},
+		{"today 17:30", at(10, 21, 17, 30)},
+		{"fri 17:30", at(10, 23, 17, 30)},
+		{"friday", at(10, 23, 9, 0)},
+		// the same weekday is next week's
+		{"wed", at(10, 28, 9, 0)},
+		// times without a day are their next occurrence
+		{"3pm", at(10, 21, 15, 0)},
+		{"9am", at(10, 22, 9, 0)},
+		{"14:30", at(10, 22, 14, 30)},
+		{"2026-10-25", at(10, 25, 9, 0)},
+		{"2026-10-25 08:15", at(10, 25, 8, 15)},
+		{"2026-10-25T08:15", at(10, 25, 8, 15)},
+		{"10/25/2026 8pm", at(10, 25, 20, 0)},
+		{"25 Oct 2026", at(10, 25, 9, 0)},
+		{"5pm UTC", at(10, 21, 17, 0)},
+		// 10:30 in new york, so 9am there is tomorrow
+		{"9am America/New_York",
+			time.Date(2026, 10, 22, 9, 0, 0, 0, newYork)},
+	}
+	for _, test := range tests {
+		got, err := ParseHumanTime(test.text, now)
+		if err != nil {
+			t.Errorf("ParseHumanTime(%q): %v", test.text, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("ParseHumanTime(%q) = %v, want %v", test.text, got,
+				test.want)
+		}
+	}
+
+	for _, text := range []string{
+		"whenever", "tomorrow 25:00", "+xh", "fri at noon", "2026-13-01",
+	} {
+		got, err := ParseHumanTime(text, now)
+		if err == nil {
+			t.Errorf("ParseHumanTime(%q) = %v, want an error", text, got)
+		}
+	}
+}
+
+func TestParseHumanDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"2h30m", 150 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1w1d1h", 8*24*time.Hour + time.Hour},
+	}
+	for _, test := range tests {
+		got, err := parseHumanDuration(test.text)
+		if err != nil {
+			t.Errorf("parseHumanDuration(%q): %v", test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseHumanDuration(%q) = %v, want %v", test.text, got,
+				test.want)
+		}
+	}
+
+	for _, text := range []string{"", "d", "1.5d", "xd", "1d2x", "soon"} {
+		got, err := parseHumanDuration(text)
+		if err == nil {
+			t.Errorf("parseHumanDuration(%q) = %v, want an error", text, got)
+		}
+	}
+}
+
+func TestParseHumanTimeOfDay(t *testing.T) {
+	tests := []struct {
+		text         string
+		hour, minute int
+	}{
+		{"9am", 9, 0},
+		{"9:30pm", 21, 30},
+		{"12am", 0, 0},
+		{"12pm", 12, 0},
+		{"17:30", 17, 30},
+		{"17", 17, 0},
+		{"00:05", 0, 5},
+	}
+	for _, test := range tests {
+		hour, minute, err := parseHumanTimeOfDay(test.text)
+		if err != nil {
+			t.Errorf("parseHumanTimeOfDay(%q): %v", test.text, err)
+			continue
+		}
+		if hour != test.hour || minute != test.minute {
+			t.Errorf("parseHumanTimeOfDay(%q) = %d:%02d, want %d:%02d",
+				test.text, hour, minute, test.hour, test.minute)
+		}
+	}
+
+	for _, text := range []string{"25", "9:75", "noon", "13pm", ""} {
+		_, _, err := parseHumanTimeOfDay(text)
+		if err == nil {
+			t.Errorf("parseHumanTimeOfDay(%q) didn't fail", text)
+		}
+	}
+}